@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+const anonymousAddressPrefix = "deleted:"
+
+// purgeUser deletes a user due for deletion with everything linked to it. Trades stay for the other side,
+// the addresses of the user in them are replaced with one pseudonym, so they still add up per seller and buyer.
+func purgeUser(rt *runtime.Runtime, userID uint, now time.Time) (bool, error) {
+	pseudonym, err := lib.GenerateToken(16)
+	if err != nil {
+		return false, err
+	}
+	pseudonym = anonymousAddressPrefix + pseudonym
+
+	purged := false
+	err = rt.Mysql.Transaction(func(tx *gorm.DB) error {
+		// the user may have restored the account meanwhile
+		var user models.User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where(
+			"id = ? AND delete_at IS NOT NULL AND delete_at <= ?", userID, now).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		var addresses []string
+		err = tx.Model(&models.MetaMask{}).Where("user_id = ?", user.ID).Pluck("address", &addresses).Error
+		if err != nil {
+			return err
+		}
+
+		if len(addresses) > 0 {
+			err = tx.Model(&models.Purchased{}).Where("seller IN ?", addresses).Update("seller", pseudonym).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Model(&models.Purchased{}).Where("buyer IN ?", addresses).Update("buyer", pseudonym).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// the emails sent to the user are personal data as well
+		if user.Email != "" {
+			if err := tx.Where("`to` = ?", user.Email).Delete(&models.OutboxEmail{}).Error; err != nil {
+				return err
+			}
+		}
+
+		// wallets, identities and the second factor go with the user, see the constraints of models.User
+		if err := tx.Delete(&user).Error; err != nil {
+			return err
+		}
+		purged = true
+		return nil
+	})
+	if err != nil || !purged {
+		return false, err
+	}
+
+	return true, RevokeUser(rt, userID)
+}
+
+// PurgeDeletedUsers deletes the users whose deletion grace period is over
+func PurgeDeletedUsers(rt *runtime.Runtime) (int, error) {
+	now := time.Now()
+	var ids []uint
+	err := rt.Mysql.Model(&models.User{}).Where(
+		"delete_at IS NOT NULL AND delete_at <= ?", now).Pluck("id", &ids).Error
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, id := range ids {
+		purged, err := purgeUser(rt, id, now)
+		if err != nil {
+			return count, err
+		}
+		if purged {
+			count++
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,55 @@
+package admin
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+type announceRequest struct {
+	Title string `json:"title" binding:"required"`
+	Text  string `json:"text" binding:"required"`
+}
+
+type announceResponse struct {
+	Queued int `json:"queued"`
+}
+
+// Announce queues an announcement to every user with an email who did not opt out of announcements
+func Announce(c *api.Context) (interface{}, *api.Error) {
+	req := announceRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	queued := 0
+	var users []models.User
+	err := c.Runtime.Mysql.Where("email IS NOT NULL AND delete_at IS NULL").FindInBatches(&users, 200, func(tx *gorm.DB, batch int) error {
+		for i := range users {
+			ok, err := api.Notify(c.Runtime, &users[i], models.NotificationAnnouncements, runtime.EmailKindAnnouncement,
+				map[string]interface{}{
+					"Title": req.Title,
+					"Text":  req.Text,
+				})
+			if err != nil {
+				// the others are still worth sending
+				log.Printf("announce to user %d: %v", users[i].ID, err)
+				continue
+			}
+			if ok {
+				queued++
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return announceResponse{Queued: queued}, nil
+}
@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"errors"
+	"strconv"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+const emailsPageSize = 100
+
+// ListEmails lists the latest emails of the outbox, optionally only those of ?status= and ?to=,
+// ?before=<id> pages back
+func ListEmails(c *api.Context) (interface{}, *api.Error) {
+	q := c.Runtime.Mysql.Model(&models.OutboxEmail{})
+
+	if status := c.GinCtx.Query("status"); status != "" {
+		switch models.OutboxStatus(status) {
+		case models.OutboxPending, models.OutboxSent, models.OutboxFailed:
+		default:
+			return nil, api.InvalidArgument(nil, "invalid status")
+		}
+		q = q.Where("status = ?", status)
+	}
+	if to := c.GinCtx.Query("to"); to != "" {
+		q = q.Where("`to` = ?", to)
+	}
+	if before := c.GinCtx.Query("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			return nil, api.InvalidArgument(nil, "invalid before")
+		}
+		q = q.Where("id < ?", id)
+	}
+
+	emails := make([]models.OutboxEmail, 0)
+	if err := q.Order("id DESC").Limit(emailsPageSize).Find(&emails).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return emails, nil
+}
+
+func GetEmail(c *api.Context) (interface{}, *api.Error) {
+	var email models.OutboxEmail
+	err := c.Runtime.Mysql.First(&email, c.GinCtx.Param("id")).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.NotFoundError()
+		}
+		return nil, api.InternalServerError()
+	}
+
+	return email, nil
+}
@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+// RevokeUser signs a user out everywhere, e.g. when the account is compromised
+func RevokeUser(c *api.Context) (interface{}, *api.Error) {
+	id := c.GinCtx.Param("id")
+
+	var user models.User
+	err := c.Runtime.Mysql.First(&user, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.NotFoundError()
+		}
+		return nil, api.InternalServerError()
+	}
+
+	if err := api.RevokeUser(c.Runtime, user.ID); err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+// ResetTwoFactor removes the second factor of a user who lost both the app and the recovery codes,
+// the user is signed out everywhere as well
+func ResetTwoFactor(c *api.Context) (interface{}, *api.Error) {
+	id := c.GinCtx.Param("id")
+
+	var user models.User
+	err := c.Runtime.Mysql.First(&user, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.NotFoundError()
+		}
+		return nil, api.InternalServerError()
+	}
+
+	err = c.Runtime.Mysql.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.TOTP{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	if err := api.RevokeUser(c.Runtime, user.ID); err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+/*
+API keys are sent as "Authorization: key <key>". they are only accepted by routes wrapped
+WithScopes, and only if the key has every scope of the route, so a key can never manage the account.
+*/
+
+const (
+	apiKeyPrefix      = "key "
+	apiKeyTag         = "agile_"
+	apiKeyBytes       = 32
+	apiKeyShownLength = len(apiKeyTag) + 8
+
+	// last used is written at most this often per key
+	apiKeyUsedInterval = time.Minute
+)
+
+var (
+	errInvalidAPIKey = errors.New("invalid api key")
+	errAPIKeyScope   = errors.New("api key scope")
+)
+
+// GenerateAPIKey returns a new key and what is kept of it
+func GenerateAPIKey() (key string, prefix string, hash string, err error) {
+	token, err := lib.GenerateToken(apiKeyBytes)
+	if err != nil {
+		return "", "", "", err
+	}
+	key = apiKeyTag + token
+	return key, key[:apiKeyShownLength], lib.HashToken(key), nil
+}
+
+// ParseScopes checks that every scope is known and drops duplicates
+func ParseScopes(scopes []string) ([]models.Scope, error) {
+	result := make([]models.Scope, 0, len(scopes))
+	seen := make(map[models.Scope]bool)
+	for _, s := range scopes {
+		scope := models.Scope(s)
+		known := false
+		for _, k := range models.Scopes {
+			if k == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, errors.New("unknown scope " + s)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			result = append(result, scope)
+		}
+	}
+	return result, nil
+}
+
+func JoinScopes(scopes []models.Scope) string {
+	s := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		s = append(s, string(scope))
+	}
+	return strings.Join(s, ",")
+}
+
+func SplitScopes(scopes string) []string {
+	if scopes == "" {
+		return []string{}
+	}
+	return strings.Split(scopes, ",")
+}
+
+// authenticateAPIKey fills c with the owner of key if the key allows the scopes of w
+func authenticateAPIKey(rt *runtime.Runtime, w *WrapConfig, key string, c *Context) error {
+	var apiKey models.APIKey
+	err := rt.Mysql.Where("hash = ?", lib.HashToken(key)).First(&apiKey).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errInvalidAPIKey
+		}
+		return err
+	}
+	now := time.Now()
+	if apiKey.ExpireAt != nil && apiKey.ExpireAt.Before(now) {
+		return errInvalidAPIKey
+	}
+
+	if len(w.Scopes) == 0 {
+		return errAPIKeyScope
+	}
+	granted := make(map[string]bool)
+	for _, s := range SplitScopes(apiKey.Scopes) {
+		granted[s] = true
+	}
+	for _, s := range w.Scopes {
+		if !granted[string(s)] {
+			return errAPIKeyScope
+		}
+	}
+
+	var user models.User
+	err = rt.Mysql.Preload("MetaMasks", func(db *gorm.DB) *gorm.DB {
+		return db.Order("is_primary DESC, id")
+	}).First(&user, apiKey.UserID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errInvalidAPIKey
+		}
+		return err
+	}
+	// keys of an account scheduled for deletion stop working at once, its sessions and sign in
+	// keep working during the grace period so that the user can call RestoreAccount
+	if user.DeleteAt != nil {
+		return errInvalidAPIKey
+	}
+	// RevokeUser deletes the keys, this refuses one created while it was doing so
+	revokedAt, err := userRevokedAt(rt, user.ID)
+	if err != nil {
+		return err
+	}
+	if revokedAt > 0 && apiKey.CreatedAt.UnixMilli() <= revokedAt {
+		return errInvalidAPIKey
+	}
+
+	c.IsLogin = true
+	c.UserID = user.ID
+	c.UserName = user.Name
+	c.UserEmail = user.Email
+	c.UserRole = user.Role
+	for _, m := range user.MetaMasks {
+		c.MetaMasks = append(c.MetaMasks, m.Address)
+	}
+	c.APIKeyID = apiKey.ID
+
+	err = rt.Mysql.Model(&models.APIKey{}).Where(
+		"id = ? AND (last_used_at IS NULL OR last_used_at < ?)", apiKey.ID, now.Add(-apiKeyUsedInterval),
+	).Update("last_used_at", now).Error
+	if err != nil {
+		log.Printf("touch api key %d: %v", apiKey.ID, err)
+	}
+
+	return nil
+}
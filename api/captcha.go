@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/runtime"
+)
+
+/*
+captchas are kept hashed under the key of what they verify, e.g. name/email/metamask:
+
+	<key>                            -> {hash: hmac-sha256([email] captchaKey, key ‖ captcha), attempts: <checks so far>}
+	captcha/cooldown/<destination>   -> 1   while no other captcha is sent to the email address or phone
+
+every check counts as an attempt before comparing, so parallel guesses are limited as well.
+the hash of the input is compared by the script, so that a captcha is consumed by the first match.
+*/
+
+const captchaCooldownPrefix = "captcha/cooldown/"
+
+// used when [email] leaves them out
+const (
+	defaultCaptchaLength   = 6
+	defaultCaptchaExpire   = 10 * time.Minute
+	defaultCaptchaAttempts = 5
+	defaultCaptchaCooldown = time.Minute
+)
+
+// KEYS[1]: captcha key, ARGV[1]: max attempts, ARGV[2]: hash of the input
+// returns 1 and deletes the captcha if input matches, 0 if not or there is no captcha left
+var checkCaptchaScript = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok ~= 'hash' then
+	return 0
+end
+local attempts = redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+if attempts > tonumber(ARGV[1]) then
+	redis.call('DEL', KEYS[1])
+	return 0
+end
+local hash = redis.call('HGET', KEYS[1], 'hash')
+if hash and hash == ARGV[2] then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+return 0
+`)
+
+func CaptchaExpire(rt *runtime.Runtime) time.Duration {
+	if rt.Config.Email.CaptchaExpire <= 0 {
+		return defaultCaptchaExpire
+	}
+	return time.Duration(rt.Config.Email.CaptchaExpire) * time.Second
+}
+
+func captchaLength(rt *runtime.Runtime) int {
+	if rt.Config.Email.CaptchaLength <= 0 {
+		return defaultCaptchaLength
+	}
+	return rt.Config.Email.CaptchaLength
+}
+
+func captchaAttempts(rt *runtime.Runtime) int {
+	if rt.Config.Email.CaptchaAttempts <= 0 {
+		return defaultCaptchaAttempts
+	}
+	return rt.Config.Email.CaptchaAttempts
+}
+
+func captchaCooldown(rt *runtime.Runtime) time.Duration {
+	if rt.Config.Email.CaptchaCooldown <= 0 {
+		return defaultCaptchaCooldown
+	}
+	return time.Duration(rt.Config.Email.CaptchaCooldown) * time.Second
+}
+
+// hashCaptcha keeps captcha from being looked up without the server key, and from verifying another key
+func hashCaptcha(rt *runtime.Runtime, key string, captcha string) string {
+	mac := hmac.New(sha256.New, []byte(rt.Config.Email.CaptchaKey))
+	mac.Write([]byte("captcha:" + key + ":" + captcha))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewCaptcha generates a captcha for key, replacing the previous one,
+// unless one was sent to destination, an email address or phone, within the cooldown
+func NewCaptcha(rt *runtime.Runtime, key string, destination string) (string, *Error) {
+	ctx := context.TODO()
+
+	cooldown := captchaCooldown(rt)
+	ok, err := rt.Redis.Cli.SetNX(ctx, captchaCooldownPrefix+destination, 1, cooldown).Result()
+	if err != nil {
+		return "", InternalServerError("redis error")
+	}
+	if !ok {
+		return "", TooManyRequests("captcha sent already, please wait before asking for another one")
+	}
+
+	captcha, err := lib.GenerateCaptcha(captchaLength(rt))
+	if err != nil {
+		return "", InternalServerError("encode captcha error")
+	}
+	pipe := rt.Redis.Cli.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, "hash", hashCaptcha(rt, key, captcha), "attempts", 0)
+	pipe.Expire(ctx, key, CaptchaExpire(rt))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", InternalServerError("redis error")
+	}
+
+	return captcha, nil
+}
+
+// CheckCaptcha compares input with the captcha of key and consumes it if it matches,
+// of concurrent requests with the right captcha only one succeeds
+func CheckCaptcha(rt *runtime.Runtime, key string, input string) *Error {
+	matched, err := checkCaptchaScript.Run(
+		context.TODO(), rt.Redis.Cli, []string{key}, captchaAttempts(rt), hashCaptcha(rt, key, input),
+	).Int()
+	if err != nil {
+		return InternalServerError("redis error")
+	}
+	if matched != 1 {
+		return InvalidArgument(nil, "invalid captcha")
+	}
+
+	return nil
+}
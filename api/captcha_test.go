@@ -0,0 +1,62 @@
+package api
+
+import "testing"
+
+func TestCaptcha(t *testing.T) {
+	rt, mr := newTestRuntime(t)
+	rt.Config.Email.CaptchaKey = "captcha key"
+	key := "name/user@example.com/"
+
+	captcha, e := NewCaptcha(rt, key, "user@example.com")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := NewCaptcha(rt, key, "user@example.com"); e == nil {
+		t.Error("second captcha sent within the cooldown")
+	}
+
+	// only the keyed hash is kept
+	stored := mr.HGet(key, "hash")
+	if stored == "" || stored != hashCaptcha(rt, key, captcha) {
+		t.Errorf("stored hash %q of %q", stored, captcha)
+	}
+	otherConfig := *rt.Config
+	otherConfig.Email.CaptchaKey = "other key"
+	otherRT := *rt
+	otherRT.Config = &otherConfig
+	if stored == hashCaptcha(rt, "other/key/", captcha) || stored == hashCaptcha(&otherRT, key, captcha) {
+		t.Error("hash does not depend on the key and the server key")
+	}
+
+	if e := CheckCaptcha(rt, "other/key/", captcha); e == nil {
+		t.Error("captcha accepted for another key")
+	}
+	if e := CheckCaptcha(rt, key, "wrong"); e == nil {
+		t.Error("wrong captcha accepted")
+	}
+	if e := CheckCaptcha(rt, key, captcha); e != nil {
+		t.Errorf("captcha rejected: %+v", e)
+	}
+	if e := CheckCaptcha(rt, key, captcha); e == nil {
+		t.Error("captcha accepted twice")
+	}
+}
+
+func TestCaptchaAttempts(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	rt.Config.Email.CaptchaKey = "captcha key"
+	key := "name/user@example.com/"
+
+	captcha, e := NewCaptcha(rt, key, "user@example.com")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < defaultCaptchaAttempts; i++ {
+		if e := CheckCaptcha(rt, key, "wrong"); e == nil {
+			t.Fatal("wrong captcha accepted")
+		}
+	}
+	if e := CheckCaptcha(rt, key, captcha); e == nil {
+		t.Error("captcha accepted after the attempts ran out")
+	}
+}
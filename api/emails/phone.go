@@ -0,0 +1,90 @@
+package emails
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+const (
+	phonePurposeSignUp string = "sign-up"
+	phonePurposeSignIn string = "sign-in"
+)
+
+type VerifyPhoneRequest struct {
+	Purpose string `json:"purpose" binding:"required,oneof=sign-up sign-in"`
+	// required when signing up
+	Name  string `json:"name"`
+	Phone string `json:"phone" binding:"required"`
+}
+
+func verifyPhone(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+	req := VerifyPhoneRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	phone, err := lib.NormalizePhone(req.Phone, rt.Config.SMS.CountryCode)
+	if err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	// phone exists?
+	count := int64(0)
+	err = rt.Mysql.Model(&models.User{}).Where(
+		"phone = ?", phone).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	var key string
+	switch req.Purpose {
+	case phonePurposeSignUp:
+		if req.Name == "" {
+			return nil, api.InvalidArgument(nil, "name is required")
+		}
+		if count > 0 {
+			return nil, api.InvalidArgument(nil, "user phone exists")
+		}
+
+		// user
+		count = int64(0)
+		err = rt.Mysql.Model(&models.User{}).Where(
+			"name = ?", req.Name).Count(&count).Error
+		if err != nil {
+			return nil, api.InternalServerError()
+		}
+		if count > 0 {
+			return nil, api.InvalidArgument(nil, "user name exists")
+		}
+
+		key = fmt.Sprintf("%s/%s/%s", req.Name, phone, "")
+	case phonePurposeSignIn:
+		if count == 0 {
+			return nil, api.InvalidArgument(nil, "unsigned up phone")
+		}
+
+		key = fmt.Sprintf("sign-in/%s", phone)
+	}
+
+	// set redis key
+	captcha, e := api.NewCaptcha(rt, key, phone)
+	if e != nil {
+		return nil, e
+	}
+
+	message := fmt.Sprintf("Your Agile verification code is %s, it expires in %d minutes.",
+		captcha, int(api.CaptchaExpire(rt).Minutes()))
+	err = rt.SMS.Send(phone, message)
+	if err != nil {
+		return nil, api.InternalServerError("send sms error")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,64 @@
+package emails
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+type unsubscribeResponse struct {
+	Notification models.Notification `json:"notification"`
+	Subscribed   bool                `json:"subscribed"`
+}
+
+// unsubscribePreferences returns the notification of the token and the preferences of its user
+func unsubscribePreferences(c *api.Context) (models.Notification, *models.NotificationPreferences, *api.Error) {
+	userID, notification, err := c.Runtime.Email.ParseUnsubscribeToken(c.GinCtx.Param("token"))
+	if err != nil {
+		return "", nil, api.InvalidArgument(nil, "invalid unsubscribe token")
+	}
+
+	var user models.User
+	if err := c.Runtime.Mysql.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil, api.NotFoundError()
+		}
+		return "", nil, api.InternalServerError()
+	}
+
+	preferences, err := api.LoadNotificationPreferences(c.Runtime.Mysql, user.ID)
+	if err != nil {
+		return "", nil, api.InternalServerError()
+	}
+	return notification, preferences, nil
+}
+
+// UnsubscribeStatus tells what a List-Unsubscribe link unsubscribes from, so that the page can ask to confirm
+func UnsubscribeStatus(c *api.Context) (interface{}, *api.Error) {
+	notification, preferences, e := unsubscribePreferences(c)
+	if e != nil {
+		return nil, e
+	}
+
+	return unsubscribeResponse{Notification: notification, Subscribed: preferences.Enabled(notification)}, nil
+}
+
+// Unsubscribe turns off the notification of a List-Unsubscribe link, also posted by mail clients (RFC 8058)
+func Unsubscribe(c *api.Context) (interface{}, *api.Error) {
+	notification, preferences, e := unsubscribePreferences(c)
+	if e != nil {
+		return nil, e
+	}
+
+	if !preferences.Set(notification, false) {
+		return nil, api.InvalidArgument(nil, "invalid unsubscribe token")
+	}
+	if err := api.SaveNotificationPreferences(c.Runtime.Mysql, preferences); err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return unsubscribeResponse{Notification: notification, Subscribed: false}, nil
+}
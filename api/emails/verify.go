@@ -1,15 +1,12 @@
 package emails
 
 import (
-	"context"
 	"fmt"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 
 	"github.com/mylakehead/agile/api"
-	"github.com/mylakehead/agile/lib"
 	"github.com/mylakehead/agile/models"
 	"github.com/mylakehead/agile/runtime"
 )
@@ -20,7 +17,8 @@ const (
 )
 
 type VerifyEmailRequest struct {
-	MetaMask string `json:"metamask" binding:"required"`
+	// empty when signing up by email and password
+	MetaMask string `json:"metamask"`
 	Name     string `json:"name" binding:"required"`
 	Email    string `json:"email" binding:"required"`
 }
@@ -32,7 +30,7 @@ func Verify(c *api.Context) (interface{}, *api.Error) {
 	case verifyTypeEmail:
 		return verifyEmail(c.Runtime, c.GinCtx)
 	case verifyTypePhone:
-		fallthrough
+		return verifyPhone(c.Runtime, c.GinCtx)
 	default:
 		return nil, api.InvalidArgument(nil, "invalid verify type")
 	}
@@ -46,18 +44,20 @@ func verifyEmail(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error)
 
 	// metamask address exists?
 	count := int64(0)
-	err := rt.Mysql.Model(&models.MetaMask{}).Where(
-		"address = ?", req.MetaMask).Count(&count).Error
-	if err != nil {
-		return nil, api.InternalServerError()
-	}
-	if count > 0 {
-		return nil, api.InvalidArgument(nil, "metamask address exists")
+	if req.MetaMask != "" {
+		err := rt.Mysql.Model(&models.MetaMask{}).Where(
+			"address = ?", req.MetaMask).Count(&count).Error
+		if err != nil {
+			return nil, api.InternalServerError()
+		}
+		if count > 0 {
+			return nil, api.InvalidArgument(nil, "metamask address exists")
+		}
 	}
 
 	// user
 	count = int64(0)
-	err = rt.Mysql.Model(&models.User{}).Where(
+	err := rt.Mysql.Model(&models.User{}).Where(
 		"name = ?", req.Name).Count(&count).Error
 	if err != nil {
 		return nil, api.InternalServerError()
@@ -79,17 +79,12 @@ func verifyEmail(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error)
 
 	// set redis key
 	key := fmt.Sprintf("%s/%s/%s", req.Name, req.Email, req.MetaMask)
-	captcha, err := lib.GenerateCaptcha(6)
-	if err != nil {
-		return nil, api.InternalServerError("encode captcha error")
-	}
-
-	err = rt.Redis.Cli.Set(context.TODO(), key, captcha, 2*time.Hour).Err()
-	if err != nil {
-		return nil, api.InternalServerError("redis error")
+	captcha, e := api.NewCaptcha(rt, key, req.Email)
+	if e != nil {
+		return nil, e
 	}
 
-	err = rt.Email.Send(captcha, req.Email)
+	err = rt.Email.Send(captcha, req.Email, api.CaptchaExpire(rt), api.RequestLocale(rt, c))
 	if err != nil {
 		return nil, api.InternalServerError("send email error")
 	}
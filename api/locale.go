@@ -0,0 +1,12 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/mylakehead/agile/runtime"
+)
+
+// RequestLocale returns the supported locale closest to the Accept-Language of the request
+func RequestLocale(rt *runtime.Runtime, c *gin.Context) string {
+	return rt.Email.Templates.Locale(c.GetHeader("Accept-Language"))
+}
@@ -0,0 +1,195 @@
+package me
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+// Export returns everything held about the user as a zip archive,
+// export.json with the account and trades.csv with the trades of its wallets.
+// Predictions are not kept per user, so there are none to export.
+func Export(c *api.Context) (interface{}, *api.Error) {
+	rt := c.Runtime
+
+	var user models.User
+	err := rt.Mysql.Preload("MetaMasks").Preload("Identities").Preload("Sessions").Preload("APIKeys").
+		First(&user, c.UserID).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	enabled, err := api.TwoFactorEnabled(rt, c.UserID)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	addresses := make([]string, 0, len(user.MetaMasks))
+	metaMasks := make([]map[string]interface{}, 0, len(user.MetaMasks))
+	for _, m := range user.MetaMasks {
+		addresses = append(addresses, m.Address)
+		metaMasks = append(metaMasks, map[string]interface{}{
+			"address":    m.Address,
+			"primary":    m.Primary,
+			"created_at": m.CreatedAt,
+		})
+	}
+	identities := make([]map[string]interface{}, 0, len(user.Identities))
+	for _, i := range user.Identities {
+		identities = append(identities, map[string]interface{}{
+			"provider":   i.Provider,
+			"subject":    i.Subject,
+			"email":      i.Email,
+			"name":       i.Name,
+			"created_at": i.CreatedAt,
+		})
+	}
+
+	sessions := make([]map[string]interface{}, 0, len(user.Sessions))
+	for _, s := range user.Sessions {
+		sessions = append(sessions, map[string]interface{}{
+			"ip":           s.IP,
+			"user_agent":   s.UserAgent,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+		})
+	}
+
+	apiKeys := make([]map[string]interface{}, 0, len(user.APIKeys))
+	for i := range user.APIKeys {
+		apiKeys = append(apiKeys, apiKeyResponse(&user.APIKeys[i]))
+	}
+
+	trades := make([]models.Purchased, 0)
+	if len(addresses) > 0 {
+		err = rt.Mysql.Where("seller IN ? OR buyer IN ?", addresses, addresses).Order("timestamp").Find(&trades).Error
+		if err != nil {
+			return nil, api.InternalServerError()
+		}
+	}
+
+	notifications, err := api.LoadNotificationPreferences(rt.Mysql, user.ID)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	account, err := json.MarshalIndent(map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":         user.ID,
+			"name":       user.Name,
+			"email":      user.Email,
+			"phone":      user.Phone,
+			"role":       user.Role,
+			"locale":     user.Locale,
+			"created_at": user.CreatedAt,
+			"updated_at": user.UpdatedAt,
+		},
+		"metamasks":  metaMasks,
+		"identities": identities,
+		"sessions":   sessions,
+		"api_keys":   apiKeys,
+		"two_factor": map[string]interface{}{
+			"enabled": enabled,
+		},
+		"notifications": notifications,
+		"trades":        trades,
+		"exported_at":   time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	var tradesCSV bytes.Buffer
+	w := csv.NewWriter(&tradesCSV)
+	records := [][]string{{"block_id", "offer_id", "seller", "buyer", "amount", "timestamp"}}
+	for _, t := range trades {
+		records = append(records, []string{
+			strconv.FormatUint(t.BlockID, 10),
+			strconv.FormatUint(t.OfferID, 10),
+			t.Seller,
+			t.Buyer,
+			strconv.FormatFloat(t.Amount, 'f', 2, 64),
+			strconv.FormatUint(t.Timestamp, 10),
+		})
+	}
+	if err := w.WriteAll(records); err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	var archive bytes.Buffer
+	z := zip.NewWriter(&archive)
+	for name, content := range map[string][]byte{
+		"export.json": account,
+		"trades.csv":  tradesCSV.Bytes(),
+	} {
+		f, err := z.Create(name)
+		if err != nil {
+			return nil, api.InternalServerError()
+		}
+		if _, err := f.Write(content); err != nil {
+			return nil, api.InternalServerError()
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return &api.Attachment{
+		Name:        fmt.Sprintf("agile-export-%d.zip", user.ID),
+		ContentType: "application/zip",
+		Data:        archive.Bytes(),
+	}, nil
+}
+
+// DeleteAccount schedules the account for deletion after the grace period of [account] deletionGrace,
+// users with two-factor authentication have to confirm with a code.
+// its API keys stop working at once, its sessions stay usable so that the deletion can be restored
+func DeleteAccount(c *api.Context) (interface{}, *api.Error) {
+	rt := c.Runtime
+
+	enabled, err := api.TwoFactorEnabled(rt, c.UserID)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if enabled {
+		if apiErr := verifyTwoFactorCode(c); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+
+	deleteAt := time.Now().Add(time.Duration(rt.Config.Account.DeletionGrace) * time.Second)
+	err = rt.Mysql.Model(&models.User{}).Where(
+		"id = ? AND delete_at IS NULL", c.UserID).Update("delete_at", deleteAt).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	var user models.User
+	if err := rt.Mysql.First(&user, c.UserID).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return map[string]interface{}{
+		"delete_at": user.DeleteAt,
+	}, nil
+}
+
+// RestoreAccount cancels a deletion during its grace period
+func RestoreAccount(c *api.Context) (interface{}, *api.Error) {
+	result := c.Runtime.Mysql.Model(&models.User{}).Where(
+		"id = ? AND delete_at IS NOT NULL", c.UserID).Update("delete_at", nil)
+	if result.Error != nil {
+		return nil, api.InternalServerError()
+	}
+	if result.RowsAffected == 0 {
+		return nil, api.InvalidArgument(nil, "account is not being deleted")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,112 @@
+package me
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+const maxAPIKeys = 20
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name" binding:"required,max=64"`
+	Scopes []string `json:"scopes" binding:"required,min=1"`
+	// never expires if 0
+	ExpireDays int `json:"expire_days" binding:"min=0"`
+}
+
+func apiKeyResponse(k *models.APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           k.ID,
+		"name":         k.Name,
+		"prefix":       k.Prefix,
+		"scopes":       api.SplitScopes(k.Scopes),
+		"created_at":   k.CreatedAt,
+		"expire_at":    k.ExpireAt,
+		"last_used_at": k.LastUsedAt,
+	}
+}
+
+func ListAPIKeys(c *api.Context) (interface{}, *api.Error) {
+	var keys []models.APIKey
+	err := c.Runtime.Mysql.Where("user_id = ?", c.UserID).Order("id").Find(&keys).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	result := make([]map[string]interface{}, 0)
+	for i := range keys {
+		result = append(result, apiKeyResponse(&keys[i]))
+	}
+
+	return result, nil
+}
+
+// CreateAPIKey returns the key, it is shown this once
+func CreateAPIKey(c *api.Context) (interface{}, *api.Error) {
+	req := createAPIKeyRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	scopes, err := api.ParseScopes(req.Scopes)
+	if err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	count := int64(0)
+	err = c.Runtime.Mysql.Model(&models.APIKey{}).Where("user_id = ?", c.UserID).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if count >= maxAPIKeys {
+		return nil, api.InvalidArgument(nil, "too many api keys")
+	}
+
+	key, prefix, hash, err := api.GenerateAPIKey()
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	apiKey := models.APIKey{
+		UserID: c.UserID,
+		Name:   req.Name,
+		Prefix: prefix,
+		Hash:   hash,
+		Scopes: api.JoinScopes(scopes),
+	}
+	if req.ExpireDays > 0 {
+		expireAt := time.Now().AddDate(0, 0, req.ExpireDays)
+		apiKey.ExpireAt = &expireAt
+	}
+	if err := c.Runtime.Mysql.Create(&apiKey).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	result := apiKeyResponse(&apiKey)
+	result["key"] = key
+	return result, nil
+}
+
+func RevokeAPIKey(c *api.Context) (interface{}, *api.Error) {
+	id := c.GinCtx.Param("id")
+
+	var apiKey models.APIKey
+	err := c.Runtime.Mysql.Where("user_id = ?", c.UserID).First(&apiKey, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.NotFoundError()
+		}
+		return nil, api.InternalServerError()
+	}
+
+	if err := c.Runtime.Mysql.Delete(&apiKey).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return nil, nil
+}
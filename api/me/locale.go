@@ -0,0 +1,32 @@
+package me
+
+import (
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+type setLocaleRequest struct {
+	Locale string `json:"locale" binding:"required"`
+}
+
+type setLocaleResponse struct {
+	Locale string `json:"locale"`
+}
+
+// SetLocale sets the locale of the emails sent to the user, to the supported locale closest to the one asked for
+func SetLocale(c *api.Context) (interface{}, *api.Error) {
+	req := setLocaleRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	locale := c.Runtime.Email.Templates.Locale(req.Locale)
+	err := c.Runtime.Mysql.Model(&models.User{}).Where("id = ?", c.UserID).Update("locale", locale).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return setLocaleResponse{Locale: locale}, nil
+}
@@ -0,0 +1,193 @@
+package me
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+type linkMetaMaskRequest struct {
+	MetaMask string `json:"metamask" binding:"required"`
+	api.SignedMessage
+}
+
+// renewToken revokes the current token and signs one with up to date MetaMasks claims
+func renewToken(c *api.Context) (interface{}, *api.Error) {
+	var user models.User
+	if err := c.Runtime.Mysql.First(&user, c.UserID).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	if err := api.RevokeToken(c.Runtime, c.TokenID, c.TokenExpire); err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	return api.RenewToken(c.Runtime, &user, c.SessionID)
+}
+
+func findMetaMask(c *api.Context, tx *gorm.DB) (*models.MetaMask, *api.Error) {
+	address := c.GinCtx.Param("address")
+
+	var metamask models.MetaMask
+	err := tx.Where("user_id = ? AND address = ?", c.UserID, address).First(&metamask).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.NotFoundError()
+		}
+		return nil, api.InternalServerError()
+	}
+
+	return &metamask, nil
+}
+
+func ListMetaMasks(c *api.Context) (interface{}, *api.Error) {
+	var metaMasks []models.MetaMask
+	err := c.Runtime.Mysql.Where("user_id = ?", c.UserID).Order("is_primary DESC, id").Find(&metaMasks).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	result := make([]map[string]interface{}, 0)
+	for _, m := range metaMasks {
+		result = append(result, map[string]interface{}{
+			"address":    m.Address,
+			"primary":    m.Primary,
+			"created_at": m.CreatedAt,
+		})
+	}
+
+	return result, nil
+}
+
+// LinkMetaMaskMessage returns the EIP-4361 message (or EIP-712 typed data) proving ownership of the address to link
+func LinkMetaMaskMessage(c *api.Context) (interface{}, *api.Error) {
+	address := c.GinCtx.Param("address")
+	if !common.IsHexAddress(address) {
+		return nil, api.InvalidArgument(nil, "invalid address")
+	}
+
+	nonce, err := api.NewSiweNonce(c.Runtime, api.SiweLinkNonceKey(c.UserID, address))
+	if err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	return api.NewSiweMessage(c, api.SiweLink, address, nonce), nil
+}
+
+func LinkMetaMask(c *api.Context) (interface{}, *api.Error) {
+	req := linkMetaMaskRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	// check sign, the nonce can only be used once
+	nonceKey := api.SiweLinkNonceKey(c.UserID, req.MetaMask)
+	if e := api.VerifySiweNonce(c.Runtime, api.SiweLink, &req.SignedMessage, req.MetaMask, nonceKey); e != nil {
+		return nil, e
+	}
+
+	// metamask address exists?
+	count := int64(0)
+	err := c.Runtime.Mysql.Model(&models.MetaMask{}).Where(
+		"address = ?", req.MetaMask).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if count > 0 {
+		return nil, api.InvalidArgument(nil, "metamask address exists")
+	}
+
+	// the first wallet of an account becomes the primary one
+	count = int64(0)
+	err = c.Runtime.Mysql.Model(&models.MetaMask{}).Where(
+		"user_id = ?", c.UserID).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	err = c.Runtime.Mysql.Create(&models.MetaMask{
+		UserID:  c.UserID,
+		Address: req.MetaMask,
+		Primary: count == 0,
+	}).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return renewToken(c)
+}
+
+func UnlinkMetaMask(c *api.Context) (interface{}, *api.Error) {
+	var user models.User
+	if err := c.Runtime.Mysql.First(&user, c.UserID).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	var e *api.Error
+	err := c.Runtime.Mysql.Transaction(func(tx *gorm.DB) error {
+		metamask, fe := findMetaMask(c, tx)
+		if fe != nil {
+			e = fe
+			return errors.New(fe.Payload.Message)
+		}
+
+		var others []models.MetaMask
+		if err := tx.Where("user_id = ? AND id <> ?", c.UserID, metamask.ID).Order("id").Find(&others).Error; err != nil {
+			return err
+		}
+		var identities int64
+		if err := tx.Model(&models.ExternalIdentity{}).Where("user_id = ?", c.UserID).Count(&identities).Error; err != nil {
+			return err
+		}
+		// never lock an account out
+		if len(others) == 0 && identities == 0 && user.Password == "" && user.Phone == "" {
+			e = api.InvalidArgument(nil, "cannot unlink the only way to sign in")
+			return errors.New(e.Payload.Message)
+		}
+
+		if err := tx.Delete(metamask).Error; err != nil {
+			return err
+		}
+		if metamask.Primary && len(others) > 0 {
+			return tx.Model(&others[0]).Update("is_primary", true).Error
+		}
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return renewToken(c)
+}
+
+func SetPrimaryMetaMask(c *api.Context) (interface{}, *api.Error) {
+	var e *api.Error
+	err := c.Runtime.Mysql.Transaction(func(tx *gorm.DB) error {
+		metamask, fe := findMetaMask(c, tx)
+		if fe != nil {
+			e = fe
+			return errors.New(fe.Payload.Message)
+		}
+
+		if err := tx.Model(&models.MetaMask{}).Where("user_id = ?", c.UserID).Update("is_primary", false).Error; err != nil {
+			return err
+		}
+		return tx.Model(metamask).Update("is_primary", true).Error
+	})
+	if e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return renewToken(c)
+}
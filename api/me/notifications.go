@@ -0,0 +1,44 @@
+package me
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+func GetNotifications(c *api.Context) (interface{}, *api.Error) {
+	preferences, err := api.LoadNotificationPreferences(c.Runtime.Mysql, c.UserID)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return preferences, nil
+}
+
+// UpdateNotifications turns the notifications in the body on or off, e.g. {"weekly_summaries": false},
+// the others are left as they are
+func UpdateNotifications(c *api.Context) (interface{}, *api.Error) {
+	req := map[string]bool{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	preferences, err := api.LoadNotificationPreferences(c.Runtime.Mysql, c.UserID)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	for name, on := range req {
+		if !preferences.Set(models.Notification(name), on) {
+			return nil, api.InvalidArgument(nil, fmt.Sprintf("unknown notification %s", name))
+		}
+	}
+
+	if err := api.SaveNotificationPreferences(c.Runtime.Mysql, preferences); err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return preferences, nil
+}
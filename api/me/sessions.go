@@ -0,0 +1,73 @@
+package me
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+func ListSessions(c *api.Context) (interface{}, *api.Error) {
+	var sessions []models.Session
+	err := c.Runtime.Mysql.Where(
+		"user_id = ? AND last_seen_at >= ?", c.UserID, api.SessionExpiredBefore(c.Runtime),
+	).Order("last_seen_at DESC").Find(&sessions).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	result := make([]map[string]interface{}, 0)
+	for _, s := range sessions {
+		result = append(result, map[string]interface{}{
+			"id":           s.ID,
+			"ip":           s.IP,
+			"user_agent":   s.UserAgent,
+			"created_at":   s.CreatedAt,
+			"last_seen_at": s.LastSeenAt,
+			"current":      s.Family == c.SessionID,
+		})
+	}
+
+	return result, nil
+}
+
+// RevokeSession signs one device out
+func RevokeSession(c *api.Context) (interface{}, *api.Error) {
+	id := c.GinCtx.Param("id")
+
+	var session models.Session
+	err := c.Runtime.Mysql.Where("user_id = ?", c.UserID).First(&session, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.NotFoundError()
+		}
+		return nil, api.InternalServerError()
+	}
+
+	if err := api.RevokeSession(c.Runtime, &session); err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return nil, nil
+}
+
+// RevokeOtherSessions signs out every device but the current one
+func RevokeOtherSessions(c *api.Context) (interface{}, *api.Error) {
+	var sessions []models.Session
+	err := c.Runtime.Mysql.Where("user_id = ? AND family <> ?", c.UserID, c.SessionID).Find(&sessions).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	for i := range sessions {
+		if err := api.RevokeSession(c.Runtime, &sessions[i]); err != nil {
+			return nil, api.InternalServerError()
+		}
+	}
+
+	return map[string]interface{}{
+		"revoked": len(sessions),
+	}, nil
+}
@@ -0,0 +1,208 @@
+package me
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+)
+
+const totpIssuer = "Agile"
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func findTOTP(c *api.Context) (*models.TOTP, *api.Error) {
+	var totp models.TOTP
+	err := c.Runtime.Mysql.Where("user_id = ?", c.UserID).First(&totp).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.NotFoundError()
+		}
+		return nil, api.InternalServerError()
+	}
+
+	return &totp, nil
+}
+
+// verifyTwoFactorCode makes changes to an enabled second factor require a current code
+func verifyTwoFactorCode(c *api.Context) *api.Error {
+	req := twoFactorCodeRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return api.InvalidArgument(nil, err.Error())
+	}
+
+	ok, e := api.CheckTwoFactorCode(c.Runtime, c.UserID, req.Code)
+	if e != nil {
+		return e
+	}
+	if !ok {
+		return api.InvalidArgument(nil, "invalid code")
+	}
+
+	return nil
+}
+
+func TwoFactor(c *api.Context) (interface{}, *api.Error) {
+	enabled, err := api.TwoFactorEnabled(c.Runtime, c.UserID)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	count := int64(0)
+	err = c.Runtime.Mysql.Model(&models.RecoveryCode{}).Where(
+		"user_id = ? AND used = ?", c.UserID, false).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return map[string]interface{}{
+		"enabled":        enabled,
+		"recovery_codes": count,
+	}, nil
+}
+
+// EnrollTOTP starts setting up an authenticator app, it is not asked for until ConfirmTOTP
+func EnrollTOTP(c *api.Context) (interface{}, *api.Error) {
+	var user models.User
+	if err := c.Runtime.Mysql.First(&user, c.UserID).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	secret, err := lib.GenerateTOTPSecret()
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	var apiErr *api.Error
+	err = c.Runtime.Mysql.Transaction(func(tx *gorm.DB) error {
+		var totp models.TOTP
+		err := tx.Where("user_id = ?", c.UserID).First(&totp).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if totp.Confirmed {
+			apiErr = api.InvalidArgument(nil, "two-factor authentication is enabled already")
+			return errors.New("totp confirmed")
+		}
+
+		totp.UserID = c.UserID
+		totp.Secret = secret
+		totp.LastCounter = 0
+		return tx.Save(&totp).Error
+	})
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Name
+	}
+
+	return map[string]interface{}{
+		"secret": secret,
+		"uri":    lib.TOTPURI(totpIssuer, account, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables two-factor authentication once the app shows the right code,
+// the recovery codes are only returned here
+func ConfirmTOTP(c *api.Context) (interface{}, *api.Error) {
+	req := twoFactorCodeRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	totp, apiErr := findTOTP(c)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if totp.Confirmed {
+		return nil, api.InvalidArgument(nil, "two-factor authentication is enabled already")
+	}
+
+	counter, ok := lib.VerifyTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		return nil, api.InvalidArgument(nil, "invalid code")
+	}
+
+	var codes []string
+	err := c.Runtime.Mysql.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(totp).Updates(map[string]interface{}{
+			"confirmed":    true,
+			"last_counter": counter,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		codes, err = api.GenerateRecoveryCodes(tx, c.UserID)
+		return err
+	})
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return map[string]interface{}{
+		"recovery_codes": codes,
+	}, nil
+}
+
+// DisableTOTP turns two-factor authentication off, a current code is required
+func DisableTOTP(c *api.Context) (interface{}, *api.Error) {
+	if _, apiErr := findTOTP(c); apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr := verifyTwoFactorCode(c); apiErr != nil {
+		return nil, apiErr
+	}
+
+	err := c.Runtime.Mysql.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", c.UserID).Delete(&models.TOTP{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", c.UserID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return nil, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, e.g. when they are used up
+func RegenerateRecoveryCodes(c *api.Context) (interface{}, *api.Error) {
+	enabled, err := api.TwoFactorEnabled(c.Runtime, c.UserID)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if !enabled {
+		return nil, api.NotFoundError()
+	}
+	if apiErr := verifyTwoFactorCode(c); apiErr != nil {
+		return nil, apiErr
+	}
+
+	var codes []string
+	err = c.Runtime.Mysql.Transaction(func(tx *gorm.DB) error {
+		codes, err = api.GenerateRecoveryCodes(tx, c.UserID)
+		return err
+	})
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return map[string]interface{}{
+		"recovery_codes": codes,
+	}, nil
+}
@@ -36,7 +36,13 @@ func Nonce(c *api.Context) (interface{}, *api.Error) {
 		return nil, api.InternalServerError()
 	}
 
+	// a new nonce on every call, the earlier ones stay valid until they expire or are consumed by signing in
+	nonce, err := api.NewSiweNonce(c.Runtime, api.SiweSignInNonceKey(address))
+	if err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
 	return map[string]string{
-		"nonce": metamask.Nonce,
+		"nonce": nonce,
 	}, nil
 }
@@ -0,0 +1,63 @@
+package metamask
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+const (
+	messageTypeSignIn string = "sign-in"
+	messageTypeSignUp string = "sign-up"
+)
+
+// Message returns the EIP-4361 message (or EIP-712 typed data with ?format=eip712) the wallet has to sign for /api/sign-in/metamask or /api/sign-up/metamask
+func Message(c *api.Context) (interface{}, *api.Error) {
+	address := c.GinCtx.Param("address")
+	if !common.IsHexAddress(address) {
+		return nil, api.InvalidArgument(nil, "invalid address")
+	}
+
+	t := c.GinCtx.Param("type")
+
+	switch t {
+	case messageTypeSignIn:
+		var metamask models.MetaMask
+		err := c.Runtime.Mysql.Where("address = ?", address).First(&metamask).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, api.NotFoundError()
+			}
+			return nil, api.InternalServerError()
+		}
+
+		nonce, err := api.NewSiweNonce(c.Runtime, api.SiweSignInNonceKey(address))
+		if err != nil {
+			return nil, api.InternalServerError("redis error")
+		}
+
+		return api.NewSiweMessage(c, api.SiweSignIn, address, nonce), nil
+	case messageTypeSignUp:
+		count := int64(0)
+		err := c.Runtime.Mysql.Model(&models.MetaMask{}).Where("address = ?", address).Count(&count).Error
+		if err != nil {
+			return nil, api.InternalServerError()
+		}
+		if count > 0 {
+			return nil, api.InvalidArgument(nil, "metamask address exists")
+		}
+
+		nonce, err := api.NewSiweNonce(c.Runtime, api.SiweSignUpNonceKey(address))
+		if err != nil {
+			return nil, api.InternalServerError("redis error")
+		}
+
+		return api.NewSiweMessage(c, api.SiweSignUp, address, nonce), nil
+	default:
+		return nil, api.InvalidArgument(nil, "invalid message type")
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+// LoadNotificationPreferences returns the preferences of userID, the defaults if none are stored
+func LoadNotificationPreferences(db *gorm.DB, userID uint) (*models.NotificationPreferences, error) {
+	var preferences models.NotificationPreferences
+	err := db.Where("user_id = ?", userID).First(&preferences).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			preferences = models.DefaultNotificationPreferences(userID)
+			return &preferences, nil
+		}
+		return nil, err
+	}
+	return &preferences, nil
+}
+
+// SaveNotificationPreferences stores preferences, inserting them the first time they are changed
+func SaveNotificationPreferences(db *gorm.DB, preferences *models.NotificationPreferences) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "trade_confirmations", "weekly_summaries", "announcements"}),
+	}).Create(preferences).Error
+}
+
+// Notify mails kind as notification to user, unless the user has no email or opted out of notification
+func Notify(
+	rt *runtime.Runtime, user *models.User, notification models.Notification, kind string, data map[string]interface{},
+) (bool, error) {
+	if user.Email == "" || user.DeleteAt != nil {
+		return false, nil
+	}
+
+	preferences, err := LoadNotificationPreferences(rt.Mysql, user.ID)
+	if err != nil {
+		return false, err
+	}
+	if !preferences.Enabled(notification) {
+		return false, nil
+	}
+
+	if err := rt.Email.SendNotification(notification, user.ID, kind, user.Locale, user.Email, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mylakehead/agile/runtime"
+)
+
+// the binding of an OAuth state, only the browser which asked for the authorization url sends it back
+// with the code, so a code and state of someone else can not sign it in (login CSRF)
+const (
+	oauthBindingCookie = "oauth_binding"
+	oauthBindingPath   = "/api"
+)
+
+// SetOAuthBinding keeps binding in a cookie until the provider redirects back
+func SetOAuthBinding(c *gin.Context, binding string) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oauthBindingCookie,
+		Value:    binding,
+		Path:     oauthBindingPath,
+		MaxAge:   int(runtime.OAuthStateExpire.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// TakeOAuthBinding returns the binding of the cookie and clears it, a state is completed once
+func TakeOAuthBinding(c *gin.Context) string {
+	binding, err := c.Cookie(oauthBindingCookie)
+	if err != nil {
+		return ""
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oauthBindingCookie,
+		Path:     oauthBindingPath,
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return binding
+}
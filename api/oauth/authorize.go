@@ -0,0 +1,28 @@
+package oauth
+
+import (
+	"errors"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/runtime"
+)
+
+// Authorize returns the url of the provider to send the user to,
+// the provider redirects back with the code and state for /api/sign-in/:provider or /api/sign-up/:provider,
+// which have to be called from the same browser, the state is bound to it with a cookie
+func Authorize(c *api.Context) (interface{}, *api.Error) {
+	provider := c.GinCtx.Param("provider")
+
+	url, binding, err := c.Runtime.OAuth.Begin(c.GinCtx.Request.Context(), provider)
+	if err != nil {
+		if errors.Is(err, runtime.ErrOAuthProvider) {
+			return nil, api.InvalidArgument(nil, err.Error())
+		}
+		return nil, api.InternalServerError("oauth error")
+	}
+	api.SetOAuthBinding(c.GinCtx, binding)
+
+	return map[string]string{
+		"url": url,
+	}, nil
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/mylakehead/agile/lib"
+)
+
+/*
+sliding window log, one sorted set per limit and subject, scored by the time of each request:
+
+	ratelimit/<name>/<ip|user|wallet>/<subject> -> {<request>: <unix ms>}
+
+the limits of a route are checked together, a request is only recorded if every one of them allows it.
+*/
+
+const rateLimitPrefix = "ratelimit/"
+
+type RateLimitBy int
+
+const (
+	RateLimitByIP RateLimitBy = iota
+	// the user signed in, the IP for anonymous requests
+	RateLimitByUser
+	// the :address of the route, else the primary wallet of the user, else the IP
+	RateLimitByWallet
+)
+
+// RateLimit allows Limit requests per Window, counted separately for each subject of By.
+// Name tells limits apart, routes using the same name share their counts.
+type RateLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	By     RateLimitBy
+}
+
+// KEYS: one key per limit, ARGV[1]: now in ms, ARGV[2]: member, then the window in ms and the limit of each key
+// returns 0 if allowed, else the ms until every limit allows a request again
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local window = tonumber(ARGV[2 * i + 1])
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+	if redis.call('ZCARD', key) >= tonumber(ARGV[2 * i + 2]) then
+		local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+		wait = math.max(wait, tonumber(oldest[2]) + window - now, 1)
+	end
+end
+if wait > 0 then
+	return wait
+end
+for i, key in ipairs(KEYS) do
+	redis.call('ZADD', key, now, ARGV[2])
+	redis.call('PEXPIRE', key, ARGV[2 * i + 1])
+end
+return 0
+`)
+
+func WithRateLimit(limits ...RateLimit) func(config *WrapConfig) {
+	return func(w *WrapConfig) {
+		w.RateLimits = append(w.RateLimits, limits...)
+	}
+}
+
+func rateLimitSubject(c *Context, by RateLimitBy) string {
+	switch by {
+	case RateLimitByUser:
+		if c.IsLogin {
+			return fmt.Sprintf("user/%d", c.UserID)
+		}
+	case RateLimitByWallet:
+		if address := c.GinCtx.Param("address"); address != "" {
+			return "wallet/" + lib.NormalizeAddress(address)
+		}
+		if len(c.MetaMasks) > 0 {
+			return "wallet/" + lib.NormalizeAddress(c.MetaMasks[0])
+		}
+	}
+	return "ip/" + c.GinCtx.ClientIP()
+}
+
+// rateLimit returns how long to wait if one of the limits of w is exceeded, 0 otherwise
+func rateLimit(c *Context, w *WrapConfig) (time.Duration, error) {
+	if len(w.RateLimits) == 0 {
+		return 0, nil
+	}
+
+	member, err := lib.GenerateToken(8)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]string, 0, len(w.RateLimits))
+	args := []interface{}{time.Now().UnixMilli(), member}
+	for _, limit := range w.RateLimits {
+		keys = append(keys, rateLimitPrefix+limit.Name+"/"+rateLimitSubject(c, limit.By))
+		args = append(args, limit.Window.Milliseconds(), limit.Limit)
+	}
+
+	wait, err := rateLimitScript.Run(context.TODO(), c.Runtime.Redis.Cli, keys, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+func abortTooManyRequests(c *Context, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	c.GinCtx.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.GinCtx.AbortWithStatusJSON(http.StatusTooManyRequests, TooManyRequests().Payload)
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mylakehead/agile/runtime"
+)
+
+// newRateLimitContext is a request from ip, with the :address param if address is set
+func newRateLimitContext(rt *runtime.Runtime, ip string, address string) *Context {
+	gin.SetMode(gin.TestMode)
+	ginCtx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ginCtx.Request = httptest.NewRequest("GET", "/", nil)
+	ginCtx.Request.RemoteAddr = ip + ":12345"
+	if address != "" {
+		ginCtx.Params = gin.Params{{Key: "address", Value: address}}
+	}
+	return &Context{Runtime: rt, GinCtx: ginCtx}
+}
+
+// allowed counts how many of n requests of c pass w
+func allowed(t *testing.T, c *Context, w *WrapConfig, n int) int {
+	t.Helper()
+
+	count := 0
+	for i := 0; i < n; i++ {
+		wait, err := rateLimit(c, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRateLimitWindow(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	c := newRateLimitContext(rt, "10.0.0.1", "")
+	w := &WrapConfig{RateLimits: []RateLimit{{Name: "test", Limit: 3, Window: 300 * time.Millisecond}}}
+
+	if n := allowed(t, c, w, 5); n != 3 {
+		t.Fatalf("%d requests allowed, want 3", n)
+	}
+	wait, err := rateLimit(c, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > 300*time.Millisecond {
+		t.Errorf("wait %v, want up to the window", wait)
+	}
+
+	// the window slides, denied requests are not counted
+	time.Sleep(wait)
+	if n := allowed(t, c, w, 5); n != 3 {
+		t.Errorf("%d requests allowed once the window passed, want 3", n)
+	}
+}
+
+func TestRateLimitSeveral(t *testing.T) {
+	rt, mr := newTestRuntime(t)
+	c := newRateLimitContext(rt, "10.0.0.1", "")
+	burst := RateLimit{Name: "burst", Limit: 2, Window: 200 * time.Millisecond}
+	hourly := RateLimit{Name: "hourly", Limit: 5, Window: time.Hour}
+	w := &WrapConfig{RateLimits: []RateLimit{hourly, burst}}
+
+	// requests denied by the burst limit do not use up the hourly one
+	for i := 0; i < 2; i++ {
+		if n := allowed(t, c, w, 4); n != 2 {
+			t.Fatalf("%d requests allowed in burst %d, want 2", n, i)
+		}
+		time.Sleep(burst.Window)
+	}
+	hourlyKey := rateLimitPrefix + "hourly/ip/10.0.0.1"
+	if count, err := mr.ZMembers(hourlyKey); err != nil || len(count) != 4 {
+		t.Fatalf("hourly count %d, %v, want 4", len(count), err)
+	}
+
+	// then the hourly limit denies, its wait is the longest
+	if n := allowed(t, c, w, 2); n != 1 {
+		t.Fatalf("%d requests allowed before the hourly limit, want 1", n)
+	}
+	time.Sleep(burst.Window)
+	wait, err := rateLimit(c, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait < time.Hour-time.Minute {
+		t.Errorf("wait %v, want the hourly window", wait)
+	}
+	burstKey := rateLimitPrefix + "burst/ip/10.0.0.1"
+	// the key of an empty window is gone
+	if members, _ := mr.ZMembers(burstKey); len(members) != 0 {
+		t.Errorf("burst window %v after a denied request, want it empty", members)
+	}
+}
+
+func TestRateLimitSubject(t *testing.T) {
+	rt, _ := newTestRuntime(t)
+	const (
+		wallet = "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"
+		other  = "0x0000000000000000000000000000000000000001"
+	)
+
+	signedIn := func(c *Context, userID uint, metaMasks ...string) *Context {
+		c.IsLogin = true
+		c.UserID = userID
+		c.MetaMasks = metaMasks
+		return c
+	}
+	for _, tc := range []struct {
+		name string
+		by   RateLimitBy
+		c    *Context
+		want string
+	}{
+		{"ip", RateLimitByIP, newRateLimitContext(rt, "10.0.0.1", ""), "ip/10.0.0.1"},
+		{"ip of a user", RateLimitByIP, signedIn(newRateLimitContext(rt, "10.0.0.1", ""), 7), "ip/10.0.0.1"},
+		{"user", RateLimitByUser, signedIn(newRateLimitContext(rt, "10.0.0.1", ""), 7), "user/7"},
+		{"anonymous user", RateLimitByUser, newRateLimitContext(rt, "10.0.0.2", ""), "ip/10.0.0.2"},
+		{"wallet of the route", RateLimitByWallet, signedIn(newRateLimitContext(rt, "10.0.0.1", wallet), 7, other),
+			"wallet/0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2"},
+		{"primary wallet", RateLimitByWallet, signedIn(newRateLimitContext(rt, "10.0.0.1", ""), 7, wallet, other),
+			"wallet/0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2"},
+		{"no wallet", RateLimitByWallet, signedIn(newRateLimitContext(rt, "10.0.0.1", ""), 7), "ip/10.0.0.1"},
+	} {
+		if got := rateLimitSubject(tc.c, tc.by); got != tc.want {
+			t.Errorf("%s: subject %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	// users share nothing with each other, nor with their IP
+	w := &WrapConfig{RateLimits: []RateLimit{{Name: "user", Limit: 1, Window: time.Hour, By: RateLimitByUser}}}
+	first := signedIn(newRateLimitContext(rt, "10.0.0.1", ""), 1)
+	second := signedIn(newRateLimitContext(rt, "10.0.0.1", ""), 2)
+	anonymous := newRateLimitContext(rt, "10.0.0.1", "")
+	for name, c := range map[string]*Context{"first": first, "second": second, "anonymous": anonymous} {
+		if n := allowed(t, c, w, 2); n != 1 {
+			t.Errorf("%s: %d requests allowed, want 1", name, n)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+/*
+revocation records live until the tokens they revoke would have expired anyway:
+
+	revoked/token/<jti>  -> 1                      a single access token
+	revoked/user/<id>    -> <unix milliseconds>    every access token of the user issued up to then
+	refresh/user/<id>    -> set of families        so that refresh tokens can be revoked by user
+*/
+
+const (
+	revokedTokenPrefix = "revoked/token/"
+	revokedUserPrefix  = "revoked/user/"
+	refreshUserPrefix  = "refresh/user/"
+)
+
+// RevokeToken revokes a single access token until it expires
+func RevokeToken(rt *runtime.Runtime, jti string, expiresAt int64) error {
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	if ttl <= 0 {
+		return nil
+	}
+	return rt.Redis.Cli.Set(context.TODO(), revokedTokenPrefix+jti, 1, ttl).Err()
+}
+
+// RevokeRefreshToken revokes the family of refreshToken if it belongs to userID
+func RevokeRefreshToken(rt *runtime.Runtime, userID uint, refreshToken string) error {
+	ctx := context.TODO()
+	hash := lib.HashToken(refreshToken)
+
+	value, err := rt.Redis.Cli.Get(ctx, refreshTokenPrefix+hash).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		return err
+	}
+	id, family, ok := strings.Cut(value, ":")
+	if !ok || id != strconv.Itoa(int(userID)) {
+		return nil
+	}
+
+	return rt.Redis.Cli.Del(ctx, refreshFamilyPrefix+family).Err()
+}
+
+// RevokeUser revokes every access and refresh token and every API key issued to userID so far
+func RevokeUser(rt *runtime.Runtime, userID uint) error {
+	ctx := context.TODO()
+
+	expire := time.Second * time.Duration(rt.Config.Jwt.Expire)
+	err := rt.Redis.Cli.Set(ctx, fmt.Sprintf("%s%d", revokedUserPrefix, userID), time.Now().UnixMilli(), expire).Err()
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%d", refreshUserPrefix, userID)
+	families, err := rt.Redis.Cli.SMembers(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{key}
+	for _, family := range families {
+		keys = append(keys, refreshFamilyPrefix+family)
+	}
+
+	if err := rt.Redis.Cli.Del(ctx, keys...).Err(); err != nil {
+		return err
+	}
+
+	if err := rt.Mysql.Where("user_id = ?", userID).Delete(&models.APIKey{}).Error; err != nil {
+		return err
+	}
+	return rt.Mysql.Where("user_id = ?", userID).Delete(&models.Session{}).Error
+}
+
+// userRevokedAt returns when every token of userID was last revoked in unix milliseconds, 0 if not
+func userRevokedAt(rt *runtime.Runtime, userID uint) (int64, error) {
+	revokedAt, err := rt.Redis.Cli.Get(context.TODO(), fmt.Sprintf("%s%d", revokedUserPrefix, userID)).Int64()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	// revoked before the milliseconds, only known to the second
+	if revokedAt < 1e12 {
+		revokedAt = revokedAt*1000 + 999
+	}
+	return revokedAt, nil
+}
+
+func isRevoked(rt *runtime.Runtime, claims *JWTClaims) (bool, error) {
+	ctx := context.TODO()
+
+	keys := []string{revokedTokenPrefix + claims.Id}
+	if claims.Session != "" {
+		keys = append(keys, revokedSessionPrefix+claims.Session)
+	}
+	n, err := rt.Redis.Cli.Exists(ctx, keys...).Result()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return true, nil
+	}
+
+	revokedAt, err := userRevokedAt(rt, claims.UserId)
+	if err != nil || revokedAt == 0 {
+		return false, err
+	}
+
+	issuedAt := claims.IssuedAtMs
+	if issuedAt == 0 {
+		// issued before iat_ms, a revocation made since is newer anyway
+		issuedAt = claims.IssuedAt * 1000
+	}
+	return issuedAt <= revokedAt, nil
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+/*
+every sign-in starts a session, a models.Session row named after its refresh token family.
+its access tokens carry the family in the sid claim, so revoking a session takes:
+
+	refresh/family/<family>    removed, the refresh token stops working
+	revoked/session/<family>   -> 1   until the access tokens of the session have expired
+*/
+
+const (
+	revokedSessionPrefix = "revoked/session/"
+
+	// last seen is written at most this often per session
+	sessionSeenInterval = time.Minute
+	userAgentLength     = 255
+)
+
+// Device is where a sign-in or a request comes from
+type Device struct {
+	IP        string
+	UserAgent string
+}
+
+func NewDevice(c *gin.Context) *Device {
+	ua := c.Request.UserAgent()
+	if len(ua) > userAgentLength {
+		ua = ua[:userAgentLength]
+	}
+	return &Device{
+		IP:        c.ClientIP(),
+		UserAgent: ua,
+	}
+}
+
+func createSession(rt *runtime.Runtime, userID uint, family string, device *Device) error {
+	now := time.Now()
+	return rt.Mysql.Create(&models.Session{
+		UserID:     userID,
+		Family:     family,
+		IP:         device.IP,
+		UserAgent:  device.UserAgent,
+		LastSeenAt: now,
+	}).Error
+}
+
+// touchSession records that the session was used from device
+func touchSession(rt *runtime.Runtime, family string, device *Device) error {
+	now := time.Now()
+	return rt.Mysql.Model(&models.Session{}).Where(
+		"family = ? AND last_seen_at < ?", family, now.Add(-sessionSeenInterval),
+	).Updates(map[string]interface{}{
+		"last_seen_at": now,
+		"ip":           device.IP,
+		"user_agent":   device.UserAgent,
+	}).Error
+}
+
+// RevokeSession signs the session out, its refresh token and access tokens stop working
+func RevokeSession(rt *runtime.Runtime, session *models.Session) error {
+	ctx := context.TODO()
+
+	expire := time.Second * time.Duration(rt.Config.Jwt.Expire)
+	pipe := rt.Redis.Cli.TxPipeline()
+	pipe.Set(ctx, revokedSessionPrefix+session.Family, 1, expire)
+	pipe.Del(ctx, refreshFamilyPrefix+session.Family)
+	pipe.SRem(ctx, fmt.Sprintf("%s%d", refreshUserPrefix, session.UserID), session.Family)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	return rt.Mysql.Delete(session).Error
+}
+
+// PurgeExpiredSessions removes the sessions whose refresh token has expired unused
+func PurgeExpiredSessions(rt *runtime.Runtime) (int64, error) {
+	result := rt.Mysql.Where("last_seen_at < ?", SessionExpiredBefore(rt)).Delete(&models.Session{})
+	return result.RowsAffected, result.Error
+}
+
+// SessionExpiredBefore is the last seen time before which sessions are expired
+func SessionExpiredBefore(rt *runtime.Runtime) time.Time {
+	return time.Now().Add(-refreshExpire(rt))
+}
+
+func seeSession(rt *runtime.Runtime, claims *JWTClaims, gCtx *gin.Context) {
+	if claims.Session == "" {
+		return
+	}
+	if err := touchSession(rt, claims.Session, NewDevice(gCtx)); err != nil {
+		log.Printf("touch session of user %d: %v", claims.UserId, err)
+	}
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/runtime"
+)
+
+// SiweKind is what a wallet signs a message for
+type SiweKind struct {
+	Statement   string
+	PrimaryType string
+}
+
+var (
+	SiweSignIn = SiweKind{Statement: "Sign in to Agile with this address.", PrimaryType: lib.TypedDataSignIn}
+	SiweSignUp = SiweKind{Statement: "Sign up to Agile with this address.", PrimaryType: lib.TypedDataSignUp}
+	SiweLink   = SiweKind{Statement: "Link this address to your Agile account.", PrimaryType: lib.TypedDataLinkWallet}
+)
+
+/*
+every message carries a nonce issued for it, which is consumed by the first valid signature.
+each nonce has a key of its own, so that messages asked for in several tabs can all be signed:
+
+	siwe/sign-in/<address>/<nonce>         -> 1
+	siwe/sign-up/<address>/<nonce>         -> 1
+	siwe/link/<user id>/<address>/<nonce>  -> 1
+*/
+
+const (
+	siweSignInNoncePrefix = "siwe/sign-in/"
+	siweSignUpNoncePrefix = "siwe/sign-up/"
+	siweLinkNoncePrefix   = "siwe/link/"
+
+	// ?format= of the message endpoints
+	siweFormatEIP712 = "eip712"
+
+	chainCallTimeout = 5 * time.Second
+)
+
+// SignedMessage is what a wallet has signed, either an EIP-4361 message with personal_sign
+// or the same fields as EIP-712 typed data with eth_signTypedData_v4
+type SignedMessage struct {
+	Message   string         `json:"message"`
+	TypedData *lib.TypedData `json:"typed_data"`
+	Sign      string         `json:"sign" binding:"required"`
+}
+
+// SiweSignInNonceKey is where the nonces of sign in messages for address are kept
+func SiweSignInNonceKey(address string) string {
+	return siweSignInNoncePrefix + lib.NormalizeAddress(address)
+}
+
+// SiweSignUpNonceKey is where the nonces of sign up messages for address are kept
+func SiweSignUpNonceKey(address string) string {
+	return siweSignUpNoncePrefix + lib.NormalizeAddress(address)
+}
+
+// SiweLinkNonceKey is where the nonces of messages linking address to userID are kept
+func SiweLinkNonceKey(userID uint, address string) string {
+	return fmt.Sprintf("%s%d/%s", siweLinkNoncePrefix, userID, lib.NormalizeAddress(address))
+}
+
+// NewSiweNonce issues a nonce under key for [siwe] expire, the nonces issued before stay valid
+func NewSiweNonce(rt *runtime.Runtime, key string) (string, error) {
+	nonce, err := lib.GenerateToken(8)
+	if err != nil {
+		return "", err
+	}
+	expire := time.Second * time.Duration(rt.Config.Siwe.Expire)
+	if err := rt.Redis.Cli.Set(context.TODO(), key+"/"+nonce, 1, expire).Err(); err != nil {
+		return "", err
+	}
+	return nonce, nil
+}
+
+// VerifySiweNonce verifies the signed message with a nonce issued under key and consumes that nonce,
+// of concurrent requests signed for the same nonce only one succeeds
+func VerifySiweNonce(rt *runtime.Runtime, kind SiweKind, signed *SignedMessage, address string, key string) *Error {
+	m, td, e := parseSiwe(rt, kind, signed)
+	if e != nil {
+		return e
+	}
+	if m.Nonce == "" {
+		return InvalidArgument(nil, lib.ErrSiweNonce.Error())
+	}
+
+	ctx := context.TODO()
+	nonceKey := key + "/" + m.Nonce
+	n, err := rt.Redis.Cli.Exists(ctx, nonceKey).Result()
+	if err != nil {
+		return InternalServerError("redis error")
+	}
+	if n == 0 {
+		return InvalidArgument(nil, "nonce expired")
+	}
+
+	if e := verifySiwe(rt, signed, m, td, address, m.Nonce); e != nil {
+		return e
+	}
+
+	consumed, err := rt.Redis.Cli.Del(ctx, nonceKey).Result()
+	if err != nil {
+		return InternalServerError("redis error")
+	}
+	if consumed == 0 {
+		return InvalidArgument(nil, "nonce expired")
+	}
+
+	return nil
+}
+
+// NewSiweMessage builds the message address has to sign from the [siwe] config,
+// as EIP-712 typed data if the request asks for ?format=eip712
+func NewSiweMessage(c *Context, kind SiweKind, address string, nonce string) interface{} {
+	rt := c.Runtime
+	expire := time.Second * time.Duration(rt.Config.Siwe.Expire)
+	m := lib.NewSiweMessage(
+		rt.Config.Siwe.Domain, address, kind.Statement, rt.Config.Siwe.URI, rt.Config.Siwe.ChainID, nonce, expire,
+	)
+
+	if c.GinCtx.Query("format") == siweFormatEIP712 {
+		return map[string]interface{}{
+			"typed_data": lib.NewTypedData(kind.PrimaryType, m),
+		}
+	}
+
+	return map[string]interface{}{
+		"message": m.String(),
+	}
+}
+
+// VerifySiwe validates every field of the signed message before checking that it was signed by address
+func VerifySiwe(rt *runtime.Runtime, kind SiweKind, signed *SignedMessage, address string, nonce string) *Error {
+	m, td, e := parseSiwe(rt, kind, signed)
+	if e != nil {
+		return e
+	}
+	return verifySiwe(rt, signed, m, td, address, nonce)
+}
+
+// parseSiwe reads the fields of the signed message, td is nil for an EIP-4361 message
+func parseSiwe(rt *runtime.Runtime, kind SiweKind, signed *SignedMessage) (*lib.SiweMessage, *lib.TypedData, *Error) {
+	var (
+		m   *lib.SiweMessage
+		td  *lib.TypedData
+		err error
+	)
+	switch {
+	case signed.TypedData != nil:
+		td, m, err = lib.ParseTypedData(signed.TypedData, kind.PrimaryType, rt.Config.Siwe.ChainID)
+	case signed.Message != "":
+		m, err = lib.ParseSiweMessage(signed.Message)
+	default:
+		return nil, nil, InvalidArgument(nil, "message or typed_data is required")
+	}
+	if err != nil {
+		return nil, nil, InvalidArgument(nil, err.Error())
+	}
+	return m, td, nil
+}
+
+func verifySiwe(
+	rt *runtime.Runtime, signed *SignedMessage, m *lib.SiweMessage, td *lib.TypedData, address string, nonce string,
+) *Error {
+	conf := rt.Config.Siwe
+	err := m.Verify(conf.Domain, conf.URI, conf.ChainID, address, nonce, time.Now())
+	if err != nil {
+		return InvalidArgument(nil, err.Error())
+	}
+
+	sig, err := hexutil.Decode(signed.Sign)
+	if err != nil {
+		return InvalidArgument(nil, "sign check error")
+	}
+	var hash []byte
+	if td != nil {
+		hash, err = td.Hash()
+		if err != nil {
+			return InvalidArgument(nil, err.Error())
+		}
+	} else {
+		hash = lib.TextHash([]byte(signed.Message))
+	}
+
+	return verifySignature(rt, hash, sig, address)
+}
+
+// verifySignature checks an externally owned account signature first,
+// then EIP-1271 if address is a smart contract wallet
+func verifySignature(rt *runtime.Runtime, hash []byte, sig []byte, address string) *Error {
+	if len(sig) == crypto.SignatureLength {
+		addr, err := lib.RecoverHash(hash, append([]byte{}, sig...))
+		if err == nil && lib.HasMatchingAddress(addr.String(), address) {
+			return nil
+		}
+	}
+
+	if rt.Chain == nil {
+		return InvalidArgument(nil, "address check error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), chainCallTimeout)
+	defer cancel()
+
+	contract := common.HexToAddress(address)
+	isContract, err := lib.IsContract(ctx, rt.Chain.Cli, contract)
+	if err != nil {
+		return InternalServerError("chain error")
+	}
+	if !isContract || !lib.IsValidSignature(ctx, rt.Chain.Cli, contract, hash, sig) {
+		return InvalidArgument(nil, "address check error")
+	}
+
+	return nil
+}
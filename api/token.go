@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+/*
+refresh tokens are opaque, only their hashes are kept in redis:
+
+	refresh/token/<hash>     -> <user id>:<family>   one record per issued refresh token
+	refresh/family/<family>  -> <hash>               the only valid refresh token of the family
+
+a refresh token is rotated on every use. presenting a token which is no longer
+the current one of its family means it has been replayed, the family is removed
+and every refresh token of it becomes invalid.
+*/
+
+const (
+	refreshTokenBytes   = 32
+	refreshFamilyBytes  = 16
+	refreshTokenPrefix  = "refresh/token/"
+	refreshFamilyPrefix = "refresh/family/"
+)
+
+// KEYS[1]: family key, ARGV[1]: presented hash, ARGV[2]: new hash, ARGV[3]: ttl in seconds
+var rotateScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[2], 'EX', ARGV[3])
+	return 1
+end
+redis.call('DEL', KEYS[1])
+return 0
+`)
+
+func refreshExpire(rt *runtime.Runtime) time.Duration {
+	return time.Second * time.Duration(rt.Config.Jwt.RefreshExpire)
+}
+
+func signAccessToken(rt *runtime.Runtime, user *models.User, session string) (string, error) {
+	// get metaMasks
+	var metaMasks []models.MetaMask
+	// the primary one goes first
+	err := rt.Mysql.Where("user_id = ?", user.ID).Order("is_primary DESC, id").Find(&metaMasks).Error
+	if err != nil {
+		return "", err
+	}
+	ms := make([]string, 0)
+	for _, m := range metaMasks {
+		ms = append(ms, m.Address)
+	}
+
+	jti, err := lib.GenerateToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	// jwt
+	now := time.Now()
+	expire := time.Second * time.Duration(rt.Config.Jwt.Expire)
+	claims := lib.JWTClaims{
+		UserId:    user.ID,
+		UserName:  user.Name,
+		UserEmail: user.Email,
+		UserRole:  user.Role,
+		MetaMasks: ms,
+		Session:   session,
+
+		IssuedAtMs: now.UnixMilli(),
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: now.Add(expire).Unix(),
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			Issuer:    "agile.lakehead",
+			Subject:   "user",
+			Audience:  "",
+			NotBefore: 0,
+		},
+	}
+	return rt.Keys.Sign(claims)
+}
+
+// newRefreshToken creates a refresh token record in family, it is not valid until the family points to it
+func newRefreshToken(rt *runtime.Runtime, userID uint, family string) (string, string, error) {
+	token, err := lib.GenerateToken(refreshTokenBytes)
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := lib.HashToken(token)
+	value := fmt.Sprintf("%d:%s", userID, family)
+	err = rt.Redis.Cli.Set(context.TODO(), refreshTokenPrefix+hash, value, refreshExpire(rt)).Err()
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, hash, nil
+}
+
+func tokenResponse(user *models.User, token string, refreshToken string) interface{} {
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":    user.ID,
+			"name":  user.Name,
+			"email": user.Email,
+			"role":  user.Role,
+		},
+		"token":         token,
+		"refresh_token": refreshToken,
+	}
+}
+
+// IssueToken signs a JWT for user, starts a new refresh token family and builds the sign-in response.
+// Users with two-factor authentication get a challenge for CompleteTwoFactor instead.
+func IssueToken(rt *runtime.Runtime, user *models.User, device *Device) (interface{}, *Error) {
+	enabled, err := TwoFactorEnabled(rt, user.ID)
+	if err != nil {
+		return nil, InternalServerError()
+	}
+	if enabled {
+		return twoFactorChallenge(rt, user)
+	}
+
+	return issueToken(rt, user, device)
+}
+
+func issueToken(rt *runtime.Runtime, user *models.User, device *Device) (interface{}, *Error) {
+	family, err := lib.GenerateToken(refreshFamilyBytes)
+	if err != nil {
+		return nil, InternalServerError("create refresh token error")
+	}
+	token, err := signAccessToken(rt, user, family)
+	if err != nil {
+		return nil, InternalServerError("create token error")
+	}
+	refreshToken, hash, err := newRefreshToken(rt, user.ID, family)
+	if err != nil {
+		return nil, InternalServerError("create refresh token error")
+	}
+	ctx := context.TODO()
+	err = rt.Redis.Cli.Set(ctx, refreshFamilyPrefix+family, hash, refreshExpire(rt)).Err()
+	if err != nil {
+		return nil, InternalServerError("create refresh token error")
+	}
+	// index families by user, see RevokeUser
+	key := fmt.Sprintf("%s%d", refreshUserPrefix, user.ID)
+	if err := rt.Redis.Cli.SAdd(ctx, key, family).Err(); err != nil {
+		return nil, InternalServerError("create refresh token error")
+	}
+	if err := rt.Redis.Cli.Expire(ctx, key, refreshExpire(rt)).Err(); err != nil {
+		return nil, InternalServerError("create refresh token error")
+	}
+	if err := createSession(rt, user.ID, family, device); err != nil {
+		return nil, InternalServerError()
+	}
+
+	return tokenResponse(user, token, refreshToken), nil
+}
+
+// RenewToken signs a new JWT for user without touching its refresh tokens,
+// used when the claims of the current one are out of date
+func RenewToken(rt *runtime.Runtime, user *models.User, session string) (interface{}, *Error) {
+	token, err := signAccessToken(rt, user, session)
+	if err != nil {
+		return nil, InternalServerError("create token error")
+	}
+
+	return map[string]interface{}{
+		"token": token,
+	}, nil
+}
+
+// RefreshToken rotates refreshToken and signs a new JWT for its owner
+func RefreshToken(rt *runtime.Runtime, refreshToken string, device *Device) (interface{}, *Error) {
+	ctx := context.TODO()
+	hash := lib.HashToken(refreshToken)
+
+	value, err := rt.Redis.Cli.Get(ctx, refreshTokenPrefix+hash).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, Unauthorized("invalid refresh token")
+		}
+		return nil, InternalServerError("redis error")
+	}
+	id, family, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, Unauthorized("invalid refresh token")
+	}
+	userID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, Unauthorized("invalid refresh token")
+	}
+
+	next, nextHash, err := newRefreshToken(rt, uint(userID), family)
+	if err != nil {
+		return nil, InternalServerError("create refresh token error")
+	}
+	rotated, err := rotateScript.Run(
+		ctx, rt.Redis.Cli,
+		[]string{refreshFamilyPrefix + family},
+		hash, nextHash, int64(refreshExpire(rt).Seconds()),
+	).Int()
+	if err != nil {
+		return nil, InternalServerError("redis error")
+	}
+	if rotated == 0 {
+		// reused or revoked, the family is gone now
+		_ = rt.Redis.Cli.Del(ctx, refreshTokenPrefix+nextHash).Err()
+		return nil, Unauthorized("invalid refresh token")
+	}
+
+	var user models.User
+	err = rt.Mysql.First(&user, userID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, Unauthorized("invalid refresh token")
+		}
+		return nil, InternalServerError()
+	}
+
+	if err := touchSession(rt, family, device); err != nil {
+		return nil, InternalServerError()
+	}
+	token, err := signAccessToken(rt, &user, family)
+	if err != nil {
+		return nil, InternalServerError("create token error")
+	}
+
+	return tokenResponse(&user, token, next), nil
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+/*
+users with a confirmed TOTP get a challenge instead of tokens when signing in,
+tokens are issued once the challenge is answered with a TOTP or recovery code:
+
+	2fa/challenge/<challenge> -> {user: <id>, attempts: <failed attempts>}
+
+failures are counted per user as well, so that starting new challenges does not allow more guesses.
+an attempt counts as a failure before its code is checked and is forgiven if the code is right,
+so that parallel guesses cannot all pass the lockout check together:
+
+	2fa/failures/<user id>    -> failed attempts in a row, until twoFactorLockout after the last one
+*/
+
+const (
+	twoFactorChallengePrefix   = "2fa/challenge/"
+	twoFactorChallengeExpire   = 5 * time.Minute
+	twoFactorChallengeAttempts = 5
+	twoFactorFailuresPrefix    = "2fa/failures/"
+	twoFactorUserAttempts      = 10
+	twoFactorLockout           = 15 * time.Minute
+
+	RecoveryCodeCount = 10
+)
+
+// count a failed attempt unless the challenge is gone already
+var failChallengeScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+end
+return 0
+`)
+
+// count an attempt unless the user is locked out, -1 if locked out
+// KEYS[1]: failures key, ARGV[1]: attempts allowed, ARGV[2]: lockout in ms
+var attemptTwoFactorScript = redis.NewScript(`
+local failures = tonumber(redis.call('GET', KEYS[1]) or '0')
+if failures >= tonumber(ARGV[1]) then
+	return -1
+end
+failures = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return failures
+`)
+
+// TwoFactorEnabled reports whether userID has to pass a second step to sign in
+func TwoFactorEnabled(rt *runtime.Runtime, userID uint) (bool, error) {
+	count := int64(0)
+	err := rt.Mysql.Model(&models.TOTP{}).Where(
+		"user_id = ? AND confirmed = ?", userID, true).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func twoFactorChallenge(rt *runtime.Runtime, user *models.User) (interface{}, *Error) {
+	challenge, err := lib.GenerateToken(32)
+	if err != nil {
+		return nil, InternalServerError()
+	}
+
+	ctx := context.TODO()
+	key := twoFactorChallengePrefix + lib.HashToken(challenge)
+	if err := rt.Redis.Cli.HSet(ctx, key, "user", user.ID, "attempts", 0).Err(); err != nil {
+		return nil, InternalServerError("redis error")
+	}
+	if err := rt.Redis.Cli.Expire(ctx, key, twoFactorChallengeExpire).Err(); err != nil {
+		return nil, InternalServerError("redis error")
+	}
+
+	return map[string]interface{}{
+		"two_factor_required": true,
+		"challenge":           challenge,
+	}, nil
+}
+
+// VerifyTwoFactorCode accepts a TOTP code or an unused recovery code of userID,
+// each of them is accepted once
+func VerifyTwoFactorCode(rt *runtime.Runtime, userID uint, code string) (bool, error) {
+	var totp models.TOTP
+	err := rt.Mysql.Where("user_id = ? AND confirmed = ?", userID, true).First(&totp).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if counter, ok := lib.VerifyTOTP(totp.Secret, code, time.Now()); ok {
+		// only move forward, so that a code cannot be replayed
+		result := rt.Mysql.Model(&models.TOTP{}).Where(
+			"id = ? AND last_counter < ?", totp.ID, counter).Update("last_counter", counter)
+		if result.Error != nil {
+			return false, result.Error
+		}
+		return result.RowsAffected == 1, nil
+	}
+
+	hash := lib.HashToken(lib.NormalizeRecoveryCode(code))
+	result := rt.Mysql.Model(&models.RecoveryCode{}).Where(
+		"user_id = ? AND hash = ? AND used = ?", userID, hash, false).Update("used", true)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// CheckTwoFactorCode is VerifyTwoFactorCode counting the failures of userID,
+// after twoFactorUserAttempts failures in a row no code is accepted until twoFactorLockout has passed
+func CheckTwoFactorCode(rt *runtime.Runtime, userID uint, code string) (bool, *Error) {
+	ctx := context.TODO()
+	key := fmt.Sprintf("%s%d", twoFactorFailuresPrefix, userID)
+
+	failures, err := attemptTwoFactorScript.Run(
+		ctx, rt.Redis.Cli, []string{key}, twoFactorUserAttempts, twoFactorLockout.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return false, InternalServerError("redis error")
+	}
+	if failures < 0 {
+		return false, TooManyRequests("too many invalid codes, please try again later")
+	}
+
+	ok, err := VerifyTwoFactorCode(rt, userID, code)
+	if err != nil {
+		return false, InternalServerError()
+	}
+	if !ok {
+		return false, nil
+	}
+
+	if err := rt.Redis.Cli.Del(ctx, key).Err(); err != nil {
+		return false, InternalServerError("redis error")
+	}
+	return true, nil
+}
+
+// GenerateRecoveryCodes replaces the recovery codes of userID, only their hashes are kept
+func GenerateRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, RecoveryCodeCount)
+	records := make([]models.RecoveryCode, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code, err := lib.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		records = append(records, models.RecoveryCode{
+			UserID: userID,
+			Hash:   lib.HashToken(lib.NormalizeRecoveryCode(code)),
+		})
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// CompleteTwoFactor answers a sign in challenge and issues the tokens
+func CompleteTwoFactor(rt *runtime.Runtime, challenge string, code string, device *Device) (interface{}, *Error) {
+	ctx := context.TODO()
+	key := twoFactorChallengePrefix + lib.HashToken(challenge)
+
+	id, err := rt.Redis.Cli.HGet(ctx, key, "user").Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, Unauthorized("invalid challenge")
+		}
+		return nil, InternalServerError("redis error")
+	}
+	userID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, Unauthorized("invalid challenge")
+	}
+
+	ok, e := CheckTwoFactorCode(rt, uint(userID), code)
+	if e != nil {
+		return nil, e
+	}
+	if !ok {
+		attempts, err := failChallengeScript.Run(ctx, rt.Redis.Cli, []string{key}).Int64()
+		if err != nil {
+			return nil, InternalServerError("redis error")
+		}
+		if attempts >= twoFactorChallengeAttempts {
+			_ = rt.Redis.Cli.Del(ctx, key).Err()
+		}
+		return nil, InvalidArgument(nil, "invalid code")
+	}
+
+	// a challenge is answered once
+	deleted, err := rt.Redis.Cli.Del(ctx, key).Result()
+	if err != nil {
+		return nil, InternalServerError("redis error")
+	}
+	if deleted == 0 {
+		return nil, Unauthorized("invalid challenge")
+	}
+
+	var user models.User
+	if err := rt.Mysql.First(&user, userID).Error; err != nil {
+		return nil, InternalServerError()
+	}
+
+	return issueToken(rt, &user, device)
+}
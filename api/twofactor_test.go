@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/glebarez/sqlite"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+// newTestRuntime returns a runtime on miniredis and an SQLite database with tables migrated
+func newTestRuntime(t *testing.T, tables ...interface{}) (*runtime.Runtime, *miniredis.Miniredis) {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "api.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite has one writer
+	sqlDB.SetMaxOpenConns(1)
+
+	mr := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = cli.Close()
+		_ = sqlDB.Close()
+	})
+
+	return &runtime.Runtime{Config: &runtime.Config{}, Mysql: db, Redis: &runtime.Redis{Cli: cli}}, mr
+}
+
+func TestCheckTwoFactorCodeLockout(t *testing.T) {
+	rt, mr := newTestRuntime(t, &models.TOTP{}, &models.RecoveryCode{})
+	secret, err := lib.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Mysql.Create(&models.TOTP{UserID: 1, Secret: secret, Confirmed: true}).Error; err != nil {
+		t.Fatal(err)
+	}
+	code, err := lib.TOTPCode(secret, time.Now().Unix()/30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parallel guesses, no more of them are checked than the user is allowed
+	var (
+		mu      sync.Mutex
+		checked int
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < 3*twoFactorUserAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, e := CheckTwoFactorCode(rt, 1, "wrong")
+			if ok || (e != nil && e.Status != http.StatusTooManyRequests) {
+				t.Errorf("wrong code: %v, %+v", ok, e)
+			}
+			if e == nil {
+				mu.Lock()
+				checked++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if checked != twoFactorUserAttempts {
+		t.Errorf("%d guesses checked, want %d", checked, twoFactorUserAttempts)
+	}
+
+	// locked out, the right code included
+	if ok, e := CheckTwoFactorCode(rt, 1, code); ok || e == nil || e.Status != http.StatusTooManyRequests {
+		t.Errorf("right code during the lockout: %v, %+v", ok, e)
+	}
+
+	// the right code after the lockout forgives the failures
+	mr.FastForward(twoFactorLockout)
+	if ok, e := CheckTwoFactorCode(rt, 1, "wrong"); ok || e != nil {
+		t.Fatalf("wrong code after the lockout: %v, %+v", ok, e)
+	}
+	if ok, e := CheckTwoFactorCode(rt, 1, code); !ok || e != nil {
+		t.Fatalf("right code after the lockout: %v, %+v", ok, e)
+	}
+	if mr.Exists(twoFactorFailuresPrefix + "1") {
+		t.Error("failures kept after the right code")
+	}
+}
@@ -0,0 +1,130 @@
+package users
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+	"github.com/mylakehead/agile/runtime"
+)
+
+type signInByOAuthRequest struct {
+	State string `json:"state" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+}
+
+type signupByOAuthRequest struct {
+	State string `json:"state" binding:"required"`
+	Code  string `json:"code" binding:"required"`
+	Name  string `json:"name" binding:"required"`
+}
+
+func completeOAuth(rt *runtime.Runtime, c *gin.Context, provider string, state string, code string) (*runtime.OAuthIdentity, *api.Error) {
+	identity, err := rt.OAuth.Complete(c.Request.Context(), provider, state, api.TakeOAuthBinding(c), code)
+	if err != nil {
+		switch {
+		case errors.Is(err, runtime.ErrOAuthProvider),
+			errors.Is(err, runtime.ErrOAuthState),
+			errors.Is(err, runtime.ErrOAuthExchange),
+			errors.Is(err, runtime.ErrOAuthIDToken):
+			return nil, api.InvalidArgument(nil, err.Error())
+		default:
+			return nil, api.InternalServerError("oauth error")
+		}
+	}
+
+	return identity, nil
+}
+
+func signInByOAuth(rt *runtime.Runtime, c *gin.Context, provider string) (interface{}, *api.Error) {
+	req := signInByOAuthRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	identity, e := completeOAuth(rt, c, provider, req.State, req.Code)
+	if e != nil {
+		return nil, e
+	}
+
+	var external models.ExternalIdentity
+	err := rt.Mysql.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&external).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.InvalidArgument(nil, "unsigned up identity")
+		}
+		return nil, api.InternalServerError()
+	}
+
+	// get user
+	var user models.User
+	err = rt.Mysql.First(&user, external.UserID).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return api.IssueToken(rt, &user, api.NewDevice(c))
+}
+
+func signupByOAuth(rt *runtime.Runtime, c *gin.Context, provider string) (interface{}, *api.Error) {
+	// result: activated user
+	//         with an external identity
+	//         without email and password
+	//         without metamask address
+	//         without phone
+	req := signupByOAuthRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	// user
+	count := int64(0)
+	err := rt.Mysql.Model(&models.User{}).Where(
+		"name = ?", req.Name).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if count > 0 {
+		return nil, api.InvalidArgument(nil, "user name exists")
+	}
+
+	identity, e := completeOAuth(rt, c, provider, req.State, req.Code)
+	if e != nil {
+		return nil, e
+	}
+
+	// identity exists?
+	count = int64(0)
+	err = rt.Mysql.Model(&models.ExternalIdentity{}).Where(
+		"provider = ? AND subject = ?", identity.Provider, identity.Subject).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if count > 0 {
+		return nil, api.InvalidArgument(nil, "identity exists")
+	}
+
+	// insert records, the email of the provider is not trusted to be verified
+	user := models.User{
+		Name:   req.Name,
+		Role:   string(models.RoleDefault),
+		Locale: api.RequestLocale(rt, c),
+		Identities: []models.ExternalIdentity{
+			{
+				Provider: identity.Provider,
+				Subject:  identity.Subject,
+				Email:    identity.Email,
+				Name:     identity.Name,
+			},
+		},
+	}
+	if err := rt.Mysql.Create(&user).Error; err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return api.IssueToken(rt, &user, api.NewDevice(c))
+}
@@ -0,0 +1,138 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+)
+
+/*
+password reset links carry a random token, only its hash is kept and only the latest link of a user works:
+
+	password/reset/token/<hash> -> <user id>
+	password/reset/user/<id>    -> <hash>
+*/
+
+const (
+	passwordResetTokenPrefix = "password/reset/token/"
+	passwordResetUserPrefix  = "password/reset/user/"
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// ForgotPassword mails a reset link, it answers the same whether the email belongs to a user or not
+func ForgotPassword(c *api.Context) (interface{}, *api.Error) {
+	rt := c.Runtime
+	req := forgotPasswordRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	var user models.User
+	err := rt.Mysql.Where("email = ?", req.Email).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, api.InternalServerError()
+	}
+
+	token, err := lib.GenerateToken(32)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	hash := lib.HashToken(token)
+
+	ctx := context.TODO()
+	userKey := fmt.Sprintf("%s%d", passwordResetUserPrefix, user.ID)
+	previous, err := rt.Redis.Cli.GetSet(ctx, userKey, hash).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, api.InternalServerError("redis error")
+	}
+	pipe := rt.Redis.Cli.TxPipeline()
+	if previous != "" {
+		pipe.Del(ctx, passwordResetTokenPrefix+previous)
+	}
+	pipe.Expire(ctx, userKey, rt.Email.ResetExpire)
+	pipe.Set(ctx, passwordResetTokenPrefix+hash, user.ID, rt.Email.ResetExpire)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	locale := user.Locale
+	if locale == "" {
+		locale = api.RequestLocale(rt, c.GinCtx)
+	}
+	if err := rt.Email.SendReset(token, user.Email, locale); err != nil {
+		// failing here would tell that the email is registered
+		log.Printf("send password reset email to user %d: %v", user.ID, err)
+	}
+
+	return nil, nil
+}
+
+// ResetPassword sets a new password with a reset token and signs the user out everywhere
+func ResetPassword(c *api.Context) (interface{}, *api.Error) {
+	rt := c.Runtime
+	req := resetPasswordRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	if err := lib.CheckPassword(req.Password); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	// a token is used once
+	ctx := context.TODO()
+	hash := lib.HashToken(req.Token)
+	id, err := rt.Redis.Cli.GetDel(ctx, passwordResetTokenPrefix+hash).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, api.InvalidArgument(nil, "invalid or expired token")
+		}
+		return nil, api.InternalServerError("redis error")
+	}
+	userID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, api.InvalidArgument(nil, "invalid or expired token")
+	}
+	if err := rt.Redis.Cli.Del(ctx, fmt.Sprintf("%s%d", passwordResetUserPrefix, userID)).Err(); err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	password, err := lib.HashPassword(req.Password)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	result := rt.Mysql.Model(&models.User{}).Where("id = ?", userID).Update("password", password)
+	if result.Error != nil {
+		return nil, api.InternalServerError()
+	}
+	if result.RowsAffected == 0 {
+		return nil, api.InvalidArgument(nil, "invalid or expired token")
+	}
+
+	if err := api.RevokeUser(rt, uint(userID)); err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	return nil, nil
+}
@@ -3,11 +3,7 @@ package users
 import (
 	"errors"
 	"fmt"
-	"strconv"
-	"time"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"gorm.io/gorm"
@@ -25,11 +21,28 @@ const (
 	signInTypeTwitter   string = "twitter"
 	signInTypeFacebook  string = "facebook"
 	signInTypeInstagram string = "instagram"
+	// second step of the above for users with two-factor authentication
+	signInTypeTOTP string = "totp"
 )
 
+type signInByEmailRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type signInByPhoneRequest struct {
+	Phone   string `json:"phone" binding:"required"`
+	Captcha string `json:"captcha" binding:"required"`
+}
+
+type signInByTOTPRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
 type signInByMetaMaskRequest struct {
 	MetaMask string `json:"metamask" binding:"required"`
-	Sign     string `json:"sign" binding:"required"`
+	api.SignedMessage
 }
 
 func SignIn(c *api.Context) (interface{}, *api.Error) {
@@ -39,55 +52,93 @@ func SignIn(c *api.Context) (interface{}, *api.Error) {
 	case signInTypeMetamask:
 		return signInByMetaMask(c.Runtime, c.GinCtx)
 	case signInTypeEmail:
-		fallthrough
+		return signInByEmail(c.Runtime, c.GinCtx)
 	case signInTypePhone:
-		fallthrough
+		return signInByPhone(c.Runtime, c.GinCtx)
 	case signInTypeTwitter:
 		fallthrough
 	case signInTypeFacebook:
 		fallthrough
 	case signInTypeInstagram:
-		fallthrough
+		return signInByOAuth(c.Runtime, c.GinCtx, t)
+	case signInTypeTOTP:
+		return signInByTOTP(c.Runtime, c.GinCtx)
 	default:
 		return nil, api.InvalidArgument(nil, "invalid sign in type")
 	}
 }
 
-func signInByMetaMask(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
-	req := signInByMetaMaskRequest{}
+func signInByEmail(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+	req := signInByEmailRequest{}
 	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
 		return nil, api.InvalidArgument(nil, err.Error())
 	}
 
-	var metamask models.MetaMask
-	err := rt.Mysql.Where("address = ?", req.MetaMask).First(&metamask).Error
+	var user models.User
+	err := rt.Mysql.Where("email = ?", req.Email).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, api.InvalidArgument(nil, "unsigned up address")
+			return nil, api.InvalidArgument(nil, "invalid email or password")
 		}
 		return nil, api.InternalServerError()
 	}
 
-	// check sign
-	data := fmt.Sprintf("Agile is signing the nonce: %s for login.", metamask.Nonce)
-	sig, err := hexutil.Decode(req.Sign)
+	if !lib.ComparePassword(user.Password, req.Password) {
+		return nil, api.InvalidArgument(nil, "invalid email or password")
+	}
+
+	return api.IssueToken(rt, &user, api.NewDevice(c))
+}
+
+func signInByPhone(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+	req := signInByPhoneRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	phone, err := lib.NormalizePhone(req.Phone, rt.Config.SMS.CountryCode)
 	if err != nil {
-		return nil, api.InvalidArgument(nil, "sign check error")
+		return nil, api.InvalidArgument(nil, err.Error())
 	}
-	addr, err := ecRecover(hexutil.Bytes(data), sig)
+
+	// check captcha
+	key := fmt.Sprintf("sign-in/%s", phone)
+	if e := api.CheckCaptcha(rt, key, req.Captcha); e != nil {
+		return nil, e
+	}
+
+	var user models.User
+	err = rt.Mysql.Where("phone = ?", phone).First(&user).Error
 	if err != nil {
-		return nil, api.InvalidArgument(nil, "sign check error")
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.InvalidArgument(nil, "unsigned up phone")
+		}
+		return nil, api.InternalServerError()
 	}
-	if !hasMatchingAddress(addr.String(), req.MetaMask) {
-		return nil, api.InvalidArgument(nil, "address check error")
+
+	return api.IssueToken(rt, &user, api.NewDevice(c))
+}
+
+func signInByMetaMask(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+	req := signInByMetaMaskRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
 	}
-	// refresh nonce
-	nonce, err := lib.GenerateCaptcha(8)
+
+	var metamask models.MetaMask
+	err := rt.Mysql.Where("address = ?", req.MetaMask).First(&metamask).Error
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.InvalidArgument(nil, "unsigned up address")
+		}
 		return nil, api.InternalServerError()
 	}
-	metamask.Nonce = nonce
-	rt.Mysql.Save(metamask)
+
+	// check sign, the nonce can only be used once
+	e := api.VerifySiweNonce(rt, api.SiweSignIn, &req.SignedMessage, req.MetaMask, api.SiweSignInNonceKey(req.MetaMask))
+	if e != nil {
+		return nil, e
+	}
 
 	// get user
 	var user models.User
@@ -96,49 +147,14 @@ func signInByMetaMask(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Er
 		return nil, api.InternalServerError()
 	}
 
-	// get metaMasks
-	var metaMasks []models.MetaMask
-	err = rt.Mysql.Where("user_id = ?", user.ID).Find(&metaMasks).Error
-	if err != nil {
-		return nil, api.InternalServerError()
-	}
-	ms := make([]string, 0)
-	for _, m := range metaMasks {
-		ms = append(ms, m.Address)
-	}
+	return api.IssueToken(rt, &user, api.NewDevice(c))
+}
 
-	// jwt
-	expire := time.Second * time.Duration(rt.Config.Jwt.Expire)
-	claims := lib.JWTClaims{
-		UserId:    user.ID,
-		UserName:  user.Name,
-		UserEmail: user.Email,
-		UserRole:  user.Role,
-		MetaMasks: ms,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(expire).Unix(),
-			Id:        strconv.Itoa(int(user.ID)),
-			IssuedAt:  0,
-			Issuer:    "agile.lakehead",
-			Subject:   "user",
-			Audience:  "",
-			NotBefore: 0,
-		},
-	}
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token, err := at.SignedString([]byte(rt.Config.Jwt.Key))
-	if err != nil {
-		return nil, api.InternalServerError("create token error")
+func signInByTOTP(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+	req := signInByTOTPRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
 	}
 
-	// TODO refresh token
-	return map[string]interface{}{
-		"user": map[string]interface{}{
-			"id":    user.ID,
-			"name":  user.Name,
-			"email": user.Email,
-			"role":  user.Role,
-		},
-		"token": token,
-	}, nil
+	return api.CompleteTwoFactor(rt, req.Challenge, req.Code, api.NewDevice(c))
 }
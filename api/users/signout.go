@@ -0,0 +1,50 @@
+package users
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/models"
+)
+
+type signOutRequest struct {
+	// optional, for tokens issued before sessions the refresh token family is revoked with it
+	RefreshToken string `json:"refresh_token"`
+}
+
+func SignOut(c *api.Context) (interface{}, *api.Error) {
+	req := signOutRequest{}
+	if c.GinCtx.Request.ContentLength > 0 {
+		if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+			return nil, api.InvalidArgument(nil, err.Error())
+		}
+	}
+
+	if err := api.RevokeToken(c.Runtime, c.TokenID, c.TokenExpire); err != nil {
+		return nil, api.InternalServerError("redis error")
+	}
+
+	if c.SessionID != "" {
+		var session models.Session
+		err := c.Runtime.Mysql.Where("user_id = ? AND family = ?", c.UserID, c.SessionID).First(&session).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, api.InternalServerError()
+		}
+		if err == nil {
+			if err := api.RevokeSession(c.Runtime, &session); err != nil {
+				return nil, api.InternalServerError()
+			}
+		}
+	}
+
+	if req.RefreshToken != "" {
+		if err := api.RevokeRefreshToken(c.Runtime, c.UserID, req.RefreshToken); err != nil {
+			return nil, api.InternalServerError("redis error")
+		}
+	}
+
+	return nil, nil
+}
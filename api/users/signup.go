@@ -1,22 +1,14 @@
 package users
 
 import (
-	"context"
-	"errors"
 	"fmt"
-	"github.com/mylakehead/agile/lib"
-	"strings"
 
-	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/hexutil"
-	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/go-redis/redis/v8"
-	"golang.org/x/crypto/sha3"
 	"gorm.io/gorm"
 
 	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/lib"
 	"github.com/mylakehead/agile/models"
 	"github.com/mylakehead/agile/runtime"
 )
@@ -30,14 +22,27 @@ const (
 	signupTypeInstagram string = "instagram"
 )
 
-type signupByMetaMaskRequest struct {
-	MetaMask string `json:"metamask" binding:"required"`
-	Sign     string `json:"sign" binding:"required"`
+type signupByEmailRequest struct {
 	Name     string `json:"name" binding:"required"`
 	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
 	Captcha  string `json:"captcha" binding:"required"`
 }
 
+type signupByPhoneRequest struct {
+	Name    string `json:"name" binding:"required"`
+	Phone   string `json:"phone" binding:"required"`
+	Captcha string `json:"captcha" binding:"required"`
+}
+
+type signupByMetaMaskRequest struct {
+	MetaMask string `json:"metamask" binding:"required"`
+	api.SignedMessage
+	Name    string `json:"name" binding:"required"`
+	Email   string `json:"email" binding:"required"`
+	Captcha string `json:"captcha" binding:"required"`
+}
+
 func SignUp(c *api.Context) (interface{}, *api.Error) {
 	t := c.GinCtx.Param("type")
 
@@ -45,79 +50,151 @@ func SignUp(c *api.Context) (interface{}, *api.Error) {
 	case signupTypeMetamask:
 		return signupByMetaMask(c.Runtime, c.GinCtx)
 	case signupTypeEmail:
-		fallthrough
+		return signupByEmail(c.Runtime, c.GinCtx)
 	case signupTypePhone:
-		fallthrough
+		return signupByPhone(c.Runtime, c.GinCtx)
 	case signupTypeTwitter:
 		fallthrough
 	case signupTypeFacebook:
 		fallthrough
 	case signupTypeInstagram:
-		fallthrough
+		return signupByOAuth(c.Runtime, c.GinCtx, t)
 	default:
 		return nil, api.InvalidArgument(nil, "invalid sign up type")
 	}
 }
 
-func hasMatchingAddress(knownAddress string, recoveredAddress string) bool {
-	return strings.ToLower(knownAddress) == strings.ToLower(recoveredAddress)
-}
+func signupByEmail(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+	// result: activated user
+	//         with email and password
+	//         without metamask address
+	//         without phone
+	req := signupByEmailRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
 
-func TextHash(data []byte) []byte {
-	hash, _ := TextAndHash(data)
-	return hash
-}
+	if err := lib.CheckPassword(req.Password); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
 
-func TextAndHash(data []byte) ([]byte, string) {
-	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(data), string(data))
-	h := sha3.NewLegacyKeccak256()
-	h.Write([]byte(msg))
-	return h.Sum(nil), msg
-}
+	// user
+	count := int64(0)
+	err := rt.Mysql.Model(&models.User{}).Where(
+		"name = ?", req.Name).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if count > 0 {
+		return nil, api.InvalidArgument(nil, "user name exists")
+	}
 
-func ecRecover(data, sig hexutil.Bytes) (common.Address, error) {
-	if len(sig) != crypto.SignatureLength {
-		return common.Address{}, fmt.Errorf("signature must be %d bytes long", crypto.SignatureLength)
+	// email
+	count = int64(0)
+	err = rt.Mysql.Model(&models.User{}).Where(
+		"email = ?", req.Email).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
 	}
-	if sig[crypto.RecoveryIDOffset] != 27 && sig[crypto.RecoveryIDOffset] != 28 {
-		return common.Address{}, fmt.Errorf("invalid Ethereum signature (V is not 27 or 28)")
+	if count > 0 {
+		return nil, api.InvalidArgument(nil, "user email exists")
+	}
+
+	// check captcha, verified without metamask address
+	key := fmt.Sprintf("%s/%s/%s", req.Name, req.Email, "")
+	if e := api.CheckCaptcha(rt, key, req.Captcha); e != nil {
+		return nil, e
 	}
-	sig[crypto.RecoveryIDOffset] -= 27 // Transform yellow paper V from 27/28 to 0/1
 
-	rpk, err := crypto.SigToPub(TextHash(data), sig)
+	// insert records
+	password, err := lib.HashPassword(req.Password)
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	err = rt.Mysql.Create(&models.User{
+		Name:     req.Name,
+		Email:    req.Email,
+		Password: password,
+		Role:     string(models.RoleDefault),
+		Locale:   api.RequestLocale(rt, c),
+	}).Error
 	if err != nil {
-		return common.Address{}, err
+		return nil, api.InternalServerError()
 	}
-	return crypto.PubkeyToAddress(*rpk), nil
+
+	return nil, nil
 }
 
-func signupByMetaMask(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+func signupByPhone(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
 	// result: activated user
-	//         with metamask address
-	//         with email
-	//         without phone
-	req := signupByMetaMaskRequest{}
+	//         with phone
+	//         without email and password
+	//         without metamask address
+	req := signupByPhoneRequest{}
 	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
 		return nil, api.InvalidArgument(nil, err.Error())
 	}
 
-	// check sign
-	data := "Agile uses this cryptographic signature to verify that you are the owner of this address."
-	sig, err := hexutil.Decode(req.Sign)
+	phone, err := lib.NormalizePhone(req.Phone, rt.Config.SMS.CountryCode)
 	if err != nil {
-		return nil, api.InvalidArgument(nil, "sign check error")
+		return nil, api.InvalidArgument(nil, err.Error())
 	}
-	addr, err := ecRecover(hexutil.Bytes(data), sig)
+
+	// user
+	count := int64(0)
+	err = rt.Mysql.Model(&models.User{}).Where(
+		"name = ?", req.Name).Count(&count).Error
 	if err != nil {
-		return nil, api.InvalidArgument(nil, err.Error())
+		return nil, api.InternalServerError()
+	}
+	if count > 0 {
+		return nil, api.InvalidArgument(nil, "user name exists")
 	}
-	if !hasMatchingAddress(addr.String(), req.MetaMask) {
-		return nil, api.InvalidArgument(nil, "address check error")
+
+	// phone
+	count = int64(0)
+	err = rt.Mysql.Model(&models.User{}).Where(
+		"phone = ?", phone).Count(&count).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+	if count > 0 {
+		return nil, api.InvalidArgument(nil, "user phone exists")
+	}
+
+	// check captcha
+	key := fmt.Sprintf("%s/%s/%s", req.Name, phone, "")
+	if e := api.CheckCaptcha(rt, key, req.Captcha); e != nil {
+		return nil, e
+	}
+
+	// insert records
+	err = rt.Mysql.Create(&models.User{
+		Name:   req.Name,
+		Phone:  phone,
+		Role:   string(models.RoleDefault),
+		Locale: api.RequestLocale(rt, c),
+	}).Error
+	if err != nil {
+		return nil, api.InternalServerError()
+	}
+
+	return nil, nil
+}
+
+func signupByMetaMask(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Error) {
+	// result: activated user
+	//         with metamask address
+	//         with email
+	//         without phone
+	req := signupByMetaMaskRequest{}
+	if err := c.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
 	}
 
 	// metamask address exists?
 	count := int64(0)
-	err = rt.Mysql.Model(&models.MetaMask{}).Where(
+	err := rt.Mysql.Model(&models.MetaMask{}).Where(
 		"address = ?", req.MetaMask).Count(&count).Error
 	if err != nil {
 		return nil, api.InternalServerError()
@@ -150,32 +227,27 @@ func signupByMetaMask(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Er
 
 	// check captcha
 	key := fmt.Sprintf("%s/%s/%s", req.Name, req.Email, req.MetaMask)
-	captcha, err := rt.Redis.Cli.Get(context.TODO(), key).Result()
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return nil, api.InvalidArgument(nil, "invalid captcha")
-		} else {
-			return nil, api.InternalServerError()
-		}
+	if e := api.CheckCaptcha(rt, key, req.Captcha); e != nil {
+		return nil, e
 	}
-	if captcha != req.Captcha {
-		return nil, api.InvalidArgument(nil, "invalid captcha")
+
+	// check sign last, the nonce can only be used once and a mistake above should not cost the signed message
+	e := api.VerifySiweNonce(rt, api.SiweSignUp, &req.SignedMessage, req.MetaMask, api.SiweSignUpNonceKey(req.MetaMask))
+	if e != nil {
+		return nil, e
 	}
 
 	// insert records
-	nonce, err := lib.GenerateCaptcha(8)
-	if err != nil {
-		return nil, api.InternalServerError()
-	}
 	err = rt.Mysql.Transaction(func(tx *gorm.DB) error {
 		if err := tx.Create(&models.User{
-			Name:  req.Name,
-			Email: req.Email,
-			Role:  string(models.RoleDefault),
+			Name:   req.Name,
+			Email:  req.Email,
+			Role:   string(models.RoleDefault),
+			Locale: api.RequestLocale(rt, c),
 			MetaMasks: []models.MetaMask{
 				{
 					Address: req.MetaMask,
-					Nonce:   nonce,
+					Primary: true,
 				},
 			},
 		}).Error; err != nil {
@@ -189,11 +261,5 @@ func signupByMetaMask(rt *runtime.Runtime, c *gin.Context) (interface{}, *api.Er
 		return nil, api.InternalServerError()
 	}
 
-	// clear redis
-	err = rt.Redis.Cli.Del(context.TODO(), key).Err()
-	if err != nil {
-		println(err.Error())
-	}
-
 	return nil, nil
 }
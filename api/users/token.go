@@ -0,0 +1,20 @@
+package users
+
+import (
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/mylakehead/agile/api"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func Refresh(c *api.Context) (interface{}, *api.Error) {
+	req := refreshRequest{}
+	if err := c.GinCtx.ShouldBindBodyWith(&req, binding.JSON); err != nil {
+		return nil, api.InvalidArgument(nil, err.Error())
+	}
+
+	return api.RefreshToken(c.Runtime, req.RefreshToken, api.NewDevice(c.GinCtx))
+}
@@ -0,0 +1,12 @@
+package wellknown
+
+import (
+	"github.com/mylakehead/agile/api"
+)
+
+// JWKS publishes the public keys tokens are signed with, so other services can verify them offline
+func JWKS(c *api.Context) (interface{}, *api.Error) {
+	c.GinCtx.Header("Cache-Control", "public, max-age=300")
+
+	return c.Runtime.Keys.JWKS(), nil
+}
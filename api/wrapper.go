@@ -2,12 +2,15 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 
 	"github.com/mylakehead/agile/code"
+	"github.com/mylakehead/agile/models"
 	"github.com/mylakehead/agile/runtime"
 )
 
@@ -27,13 +30,29 @@ type Handler func(c *Context) (interface{}, *Error)
 type DataType int
 
 const (
-	DataTypeJson     DataType = iota // exactly JSON and already JSON header set
-	DataTypeJsonStr                  // exactly JSON but with no JSON header set
-	DataTypePlainStr                 // plain text
+	DataTypeJson       DataType = iota // exactly JSON and already JSON header set
+	DataTypeJsonStr                    // exactly JSON but with no JSON header set
+	DataTypePlainStr                   // plain text
+	DataTypeAttachment                 // *Attachment, downloaded as a file
 )
 
+// Attachment is the response of handlers wrapped with DataTypeAttachment
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
 type WrapConfig struct {
 	RespDataType DataType
+	// the user needs one of the roles, implies login
+	Roles []models.Role
+	// the role of the user needs all the permissions, implies login
+	Permissions []models.Permission
+	// API keys with all the scopes are accepted besides tokens, implies login
+	Scopes []models.Scope
+	// every limit has to allow the request
+	RateLimits []RateLimit
 }
 
 func WithDataType(t DataType) func(config *WrapConfig) {
@@ -42,6 +61,24 @@ func WithDataType(t DataType) func(config *WrapConfig) {
 	}
 }
 
+func WithRoles(roles ...models.Role) func(config *WrapConfig) {
+	return func(w *WrapConfig) {
+		w.Roles = roles
+	}
+}
+
+func WithPermissions(permissions ...models.Permission) func(config *WrapConfig) {
+	return func(w *WrapConfig) {
+		w.Permissions = permissions
+	}
+}
+
+func WithScopes(scopes ...models.Scope) func(config *WrapConfig) {
+	return func(w *WrapConfig) {
+		w.Scopes = scopes
+	}
+}
+
 type Context struct {
 	Runtime   *runtime.Runtime
 	GinCtx    *gin.Context
@@ -51,14 +88,19 @@ type Context struct {
 	UserEmail string
 	UserRole  string
 	MetaMasks []string
+	// id and expiry of the access token, empty if not logged in
+	TokenID     string
+	TokenExpire int64
+	// refresh token family of the sign-in, empty for tokens issued before sessions
+	SessionID string
+	// API key the request is authenticated with, 0 for tokens
+	APIKeyID uint
 }
 
 const tokenPrefix = "token "
 
-func parseToken(token string, key []byte) (*JWTClaims, error) {
-	tokenClaims, err := jwt.ParseWithClaims(token, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return key, nil
-	})
+func parseToken(token string, keyFunc jwt.Keyfunc) (*JWTClaims, error) {
+	tokenClaims, err := jwt.ParseWithClaims(token, &JWTClaims{}, keyFunc)
 	if err != nil {
 		return nil, err
 	}
@@ -78,11 +120,41 @@ func parseToken(token string, key []byte) (*JWTClaims, error) {
 	return claims, nil
 }
 
+func authorize(rt *runtime.Runtime, w *WrapConfig, role string) (bool, error) {
+	if len(w.Roles) > 0 {
+		found := false
+		for _, r := range w.Roles {
+			if string(r) == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+
+	if len(w.Permissions) > 0 {
+		count := int64(0)
+		err := rt.Mysql.Model(&models.RolePermission{}).Where(
+			"role = ? AND permission IN ?", role, w.Permissions).Count(&count).Error
+		if err != nil {
+			return false, err
+		}
+		if count < int64(len(w.Permissions)) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
 // Wrap
 // success:               status - 200
 // bad request:           status - 400
 // unauthorized:          status - 401
 // forbidden:             status - 403
+// too many requests:     status - 429
 // internal server error: status - 500
 func Wrap(h Handler, rt *runtime.Runtime, loginRequired bool, opts ...func(*WrapConfig)) gin.HandlerFunc {
 	w := &WrapConfig{
@@ -92,6 +164,9 @@ func Wrap(h Handler, rt *runtime.Runtime, loginRequired bool, opts ...func(*Wrap
 	for _, opt := range opts {
 		opt(w)
 	}
+	if len(w.Roles) > 0 || len(w.Permissions) > 0 || len(w.Scopes) > 0 {
+		loginRequired = true
+	}
 
 	return func(gCtx *gin.Context) {
 		c := Context{
@@ -107,22 +182,81 @@ func Wrap(h Handler, rt *runtime.Runtime, loginRequired bool, opts ...func(*Wrap
 
 		if loginRequired {
 			authToken := gCtx.GetHeader("Authorization")
-			if len(authToken) <= len(tokenPrefix) {
-				gCtx.AbortWithStatus(401)
+			var claims *JWTClaims
+			if strings.HasPrefix(authToken, apiKeyPrefix) {
+				err := authenticateAPIKey(rt, w, authToken[len(apiKeyPrefix):], &c)
+				if errors.Is(err, errInvalidAPIKey) {
+					gCtx.AbortWithStatus(401)
+					return
+				}
+				if errors.Is(err, errAPIKeyScope) {
+					gCtx.AbortWithStatusJSON(http.StatusForbidden, Forbidden().Payload)
+					return
+				}
+				if err != nil {
+					gCtx.String(http.StatusInternalServerError, "mysql error")
+					gCtx.Abort()
+					return
+				}
+			} else {
+				if len(authToken) <= len(tokenPrefix) {
+					gCtx.AbortWithStatus(401)
+					return
+				}
+				token := authToken[len(tokenPrefix):]
+				var err error
+				claims, err = parseToken(token, rt.Keys.Keyfunc)
+				if err != nil {
+					gCtx.AbortWithStatus(401)
+					return
+				}
+				revoked, err := isRevoked(rt, claims)
+				if err != nil {
+					gCtx.String(http.StatusInternalServerError, "redis error")
+					gCtx.Abort()
+					return
+				}
+				if revoked {
+					gCtx.AbortWithStatus(401)
+					return
+				}
+				c.IsLogin = true
+				c.UserID = claims.UserId
+				c.UserName = claims.UserName
+				c.UserEmail = claims.UserEmail
+				c.UserRole = claims.UserRole
+				c.MetaMasks = claims.MetaMasks
+				c.TokenID = claims.Id
+				c.TokenExpire = claims.ExpiresAt
+				c.SessionID = claims.Session
+			}
+
+			allowed, err := authorize(rt, w, c.UserRole)
+			if err != nil {
+				gCtx.String(http.StatusInternalServerError, "mysql error")
+				gCtx.Abort()
+				return
+			}
+			if !allowed {
+				gCtx.AbortWithStatusJSON(http.StatusForbidden, Forbidden().Payload)
 				return
 			}
-			token := authToken[len(tokenPrefix):]
-			claims, err := parseToken(token, []byte(rt.Config.Jwt.Key))
+			if claims != nil {
+				seeSession(rt, claims, gCtx)
+			}
+		}
+
+		if len(w.RateLimits) > 0 {
+			wait, err := rateLimit(&c, w)
 			if err != nil {
-				gCtx.AbortWithStatus(401)
+				gCtx.String(http.StatusInternalServerError, "redis error")
+				gCtx.Abort()
+				return
+			}
+			if wait > 0 {
+				abortTooManyRequests(&c, wait)
 				return
 			}
-			c.IsLogin = true
-			c.UserID = claims.UserId
-			c.UserName = claims.UserName
-			c.UserEmail = claims.UserEmail
-			c.UserRole = claims.UserRole
-			c.MetaMasks = claims.MetaMasks
 		}
 
 		data, err := h(&c)
@@ -144,6 +278,10 @@ func Wrap(h Handler, rt *runtime.Runtime, loginRequired bool, opts ...func(*Wrap
 				gCtx.String(http.StatusOK, data.(string))
 			case DataTypePlainStr:
 				gCtx.String(http.StatusOK, data.(string))
+			case DataTypeAttachment:
+				a := data.(*Attachment)
+				gCtx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.Name))
+				gCtx.Data(http.StatusOK, a.ContentType, a.Data)
 			default:
 				gCtx.JSON(http.StatusOK, data)
 			}
@@ -191,6 +329,66 @@ func InternalServerError(messages ...string) *Error {
 	}
 }
 
+func Unauthorized(messages ...string) *Error {
+	if len(messages) > 0 {
+		return &Error{
+			Status: http.StatusUnauthorized,
+			Payload: &Payload{
+				Code:    code.Code(code.InvalidToken),
+				Message: messages[0],
+			},
+		}
+	}
+
+	return &Error{
+		Status: http.StatusUnauthorized,
+		Payload: &Payload{
+			Code:    code.Code(code.InvalidToken),
+			Message: code.InvalidToken.String(),
+		},
+	}
+}
+
+func Forbidden(messages ...string) *Error {
+	if len(messages) > 0 {
+		return &Error{
+			Status: http.StatusForbidden,
+			Payload: &Payload{
+				Code:    code.PermissionDenied,
+				Message: messages[0],
+			},
+		}
+	}
+
+	return &Error{
+		Status: http.StatusForbidden,
+		Payload: &Payload{
+			Code:    code.PermissionDenied,
+			Message: code.PermissionDenied.String(),
+		},
+	}
+}
+
+func TooManyRequests(messages ...string) *Error {
+	if len(messages) > 0 {
+		return &Error{
+			Status: http.StatusTooManyRequests,
+			Payload: &Payload{
+				Code:    code.TooManyRequests,
+				Message: messages[0],
+			},
+		}
+	}
+
+	return &Error{
+		Status: http.StatusTooManyRequests,
+		Payload: &Payload{
+			Code:    code.TooManyRequests,
+			Message: code.TooManyRequests.String(),
+		},
+	}
+}
+
 func NotFoundError(messages ...string) *Error {
 	if len(messages) > 0 {
 		return &Error{
@@ -8,9 +8,11 @@ error code description: 4(placeholder) 000-999(service) 00000-99999(code)
 */
 
 const (
-	InvalidArgument Code = 400000000
-	NotFoundError   Code = 400000001
-	UnknownError    Code = 400099999
+	InvalidArgument  Code = 400000000
+	NotFoundError    Code = 400000001
+	PermissionDenied Code = 400000002
+	TooManyRequests  Code = 400000003
+	UnknownError     Code = 400099999
 )
 
 func (c Code) String() string {
@@ -19,6 +21,10 @@ func (c Code) String() string {
 		return "invalid argument"
 	case NotFoundError:
 		return "not found"
+	case PermissionDenied:
+		return "permission denied"
+	case TooManyRequests:
+		return "too many requests"
 	case UnknownError:
 		return "unknown error"
 	default:
@@ -7,14 +7,26 @@ import (
 
 var table = [...]byte{'1', '2', '3', '4', '5', '6', '7', '8', '9', '0'}
 
+// bytes from 250 up are dropped, so that every digit is equally likely
+const captchaByteLimit = 256 - 256%len(table)
+
 func GenerateCaptcha(max int) (string, error) {
 	b := make([]byte, max)
-	n, err := io.ReadAtLeast(rand.Reader, b, max)
-	if n != max {
-		return "", err
-	}
-	for i := 0; i < len(b); i++ {
-		b[i] = table[int(b[i])%len(table)]
+	buf := make([]byte, max)
+	for i := 0; i < max; {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return "", err
+		}
+		for _, r := range buf {
+			if int(r) >= captchaByteLimit {
+				continue
+			}
+			b[i] = table[int(r)%len(table)]
+			i++
+			if i == max {
+				break
+			}
+		}
 	}
 	return string(b), nil
 }
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// the Ed25519 signing example of RFC 8037, appendix A.4
+const (
+	eddsaTestD            = "nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A"
+	eddsaTestX            = "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"
+	eddsaTestSigningInput = "eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc"
+	eddsaTestSignature    = "hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg"
+)
+
+func TestEdDSA(t *testing.T) {
+	seed, err := base64.RawURLEncoding.DecodeString(eddsaTestD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(eddsaTestX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey := ed25519.NewKeyFromSeed(seed)
+	publicKey := ed25519.PublicKey(x)
+	if !publicKey.Equal(privateKey.Public()) {
+		t.Fatal("x is not the public key of d")
+	}
+
+	signature, err := EdDSA.Sign(eddsaTestSigningInput, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != eddsaTestSignature {
+		t.Errorf("signature %s, want %s", signature, eddsaTestSignature)
+	}
+	if err := EdDSA.Verify(eddsaTestSigningInput, eddsaTestSignature, publicKey); err != nil {
+		t.Errorf("signature rejected: %v", err)
+	}
+	if err := EdDSA.Verify(eddsaTestSigningInput+"x", eddsaTestSignature, publicKey); err == nil {
+		t.Error("signature of another input accepted")
+	}
+
+	// keys of another type, the private key included
+	if _, err := EdDSA.Sign(eddsaTestSigningInput, publicKey); err != jwt.ErrInvalidKeyType {
+		t.Errorf("signed with a public key: %v", err)
+	}
+	if err := EdDSA.Verify(eddsaTestSigningInput, eddsaTestSignature, privateKey); err != jwt.ErrInvalidKeyType {
+		t.Errorf("verified with a private key: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// EIP-1271 standard signature validation method for contracts, https://eips.ethereum.org/EIPS/eip-1271
+
+// isValidSignature(bytes32,bytes) selector, also the magic value returned for a valid signature
+var eip1271MagicValue = []byte{0x16, 0x26, 0xba, 0x7e}
+
+// ContractCaller is the part of a chain client needed to ask contract wallets about signatures
+type ContractCaller interface {
+	CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error)
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+}
+
+func encodeIsValidSignature(hash []byte, sig []byte) []byte {
+	data := append([]byte{}, eip1271MagicValue...)
+	data = append(data, common.LeftPadBytes(hash, 32)...)
+	// offset of the dynamic bytes argument
+	data = append(data, common.LeftPadBytes(big.NewInt(64).Bytes(), 32)...)
+	data = append(data, common.LeftPadBytes(big.NewInt(int64(len(sig))).Bytes(), 32)...)
+	padded := (len(sig) + 31) / 32 * 32
+	data = append(data, common.RightPadBytes(sig, padded)...)
+	return data
+}
+
+// IsContract reports whether address has code, i.e. is a smart contract wallet
+func IsContract(ctx context.Context, caller ContractCaller, address common.Address) (bool, error) {
+	code, err := caller.CodeAt(ctx, address, nil)
+	if err != nil {
+		return false, err
+	}
+	return len(code) > 0, nil
+}
+
+// IsValidSignature calls isValidSignature on the contract wallet at address.
+// A reverted call counts as an invalid signature, as contract wallets may revert instead of
+// returning something else than the magic value.
+func IsValidSignature(ctx context.Context, caller ContractCaller, address common.Address, hash []byte, sig []byte) bool {
+	result, err := caller.CallContract(ctx, ethereum.CallMsg{
+		To:   &address,
+		Data: encodeIsValidSignature(hash, sig),
+	}, nil)
+	if err != nil || len(result) < len(eip1271MagicValue) {
+		return false
+	}
+
+	// bytes4 is left aligned in its 32 bytes word
+	for i, b := range eip1271MagicValue {
+		if result[i] != b {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// wallet1271 returns the runtime code of a contract wallet whose isValidSignature
+// returns the magic value for hash and 0xffffffff for any other hash
+func wallet1271(hash common.Hash) []byte {
+	var code []byte
+	code = append(code, 0x60, 0x04, 0x35) // CALLDATALOAD(4), the hash argument
+	code = append(code, 0x7f)             // PUSH32 hash
+	code = append(code, hash.Bytes()...)
+	code = append(code, 0x14, 0x60, 0x38, 0x57) // EQ, JUMPI to the magic value
+	code = append(code, 0x63, 0xff, 0xff, 0xff, 0xff, 0x60, 0xe0, 0x1b)
+	code = append(code, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3) // return 0xffffffff left aligned
+	code = append(code, 0x5b, 0x63)                                     // JUMPDEST at 0x38
+	code = append(code, eip1271MagicValue...)
+	code = append(code, 0x60, 0xe0, 0x1b)
+	code = append(code, 0x60, 0x00, 0x52, 0x60, 0x20, 0x60, 0x00, 0xf3) // return the magic value left aligned
+	return code
+}
+
+// revert1271 reverts every call
+var revert1271 = []byte{0x60, 0x00, 0x60, 0x00, 0xfd}
+
+// deploy creates a contract with runtime code, returning its address
+func deploy(t *testing.T, backend *simulated.Backend, key []byte, code []byte) common.Address {
+	t.Helper()
+
+	privateKey, err := crypto.ToECDSA(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(privateKey.PublicKey)
+	cli := backend.Client()
+	ctx := context.Background()
+
+	nonce, err := cli.PendingNonceAt(ctx, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// copies the runtime code behind these 11 bytes into memory and returns it
+	init := append([]byte{0x60, byte(len(code)), 0x80, 0x60, 0x0b, 0x60, 0x00, 0x39, 0x60, 0x00, 0xf3}, code...)
+	tx, err := types.SignTx(types.NewContractCreation(nonce, big.NewInt(0), 1_000_000, big.NewInt(params.GWei*10), init),
+		types.LatestSignerForChainID(params.AllDevChainProtocolChanges.ChainID), privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.SendTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	backend.Commit()
+
+	address := crypto.CreateAddress(from, nonce)
+	deployed, err := cli.CodeAt(ctx, address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(deployed, code) {
+		t.Fatalf("deployed code %x, want %x", deployed, code)
+	}
+	return address
+}
+
+func TestIsValidSignature(t *testing.T) {
+	key := crypto.Keccak256([]byte("eip1271"))
+	privateKey, err := crypto.ToECDSA(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(privateKey.PublicKey): {Balance: big.NewInt(params.Ether)},
+	})
+	defer backend.Close()
+	cli := backend.Client()
+	ctx := context.Background()
+
+	hash := crypto.Keccak256Hash([]byte("message"))
+	wallet := deploy(t, backend, key, wallet1271(hash))
+	reverting := deploy(t, backend, key, revert1271)
+	sig := []byte{1, 2, 3}
+
+	isContract, err := IsContract(ctx, cli, wallet)
+	if err != nil || !isContract {
+		t.Fatalf("IsContract(wallet) = %v, %v", isContract, err)
+	}
+	isContract, err = IsContract(ctx, cli, crypto.PubkeyToAddress(privateKey.PublicKey))
+	if err != nil || isContract {
+		t.Fatalf("IsContract(account) = %v, %v", isContract, err)
+	}
+
+	if !IsValidSignature(ctx, cli, wallet, hash.Bytes(), sig) {
+		t.Error("magic value not accepted")
+	}
+	other := crypto.Keccak256([]byte("other message"))
+	if IsValidSignature(ctx, cli, wallet, other, sig) {
+		t.Error("0xffffffff accepted")
+	}
+	if IsValidSignature(ctx, cli, reverting, hash.Bytes(), sig) {
+		t.Error("reverted call accepted")
+	}
+}
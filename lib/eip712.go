@@ -0,0 +1,223 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// EIP-712 typed structured data, https://eips.ethereum.org/EIPS/eip-712
+//
+// only the flat structs below are supported, they carry the same fields as a SiweMessage
+// so that both formats are validated the same way
+
+const (
+	TypedDataSignIn     = "SignIn"
+	TypedDataSignUp     = "SignUp"
+	TypedDataLinkWallet = "LinkWallet"
+
+	typedDataDomainType = "EIP712Domain"
+	typedDataName       = "Agile"
+	typedDataVersion    = "1"
+)
+
+var ErrTypedDataMalformed = errors.New("malformed typed data")
+
+type TypedDataField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type TypedDataDomain struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	ChainId int64  `json:"chainId"`
+}
+
+// TypedData is the argument of eth_signTypedData_v4
+type TypedData struct {
+	Types       map[string][]TypedDataField `json:"types"`
+	PrimaryType string                      `json:"primaryType"`
+	Domain      TypedDataDomain             `json:"domain"`
+	Message     map[string]string           `json:"message"`
+}
+
+var typedDataDomainFields = []TypedDataField{
+	{Name: "name", Type: "string"},
+	{Name: "version", Type: "string"},
+	{Name: "chainId", Type: "uint256"},
+}
+
+// the domain is signed as part of the message, the EIP712Domain has no field for the origin of the request
+var typedDataAuthFields = []TypedDataField{
+	{Name: "domain", Type: "string"},
+	{Name: "statement", Type: "string"},
+	{Name: "address", Type: "address"},
+	{Name: "uri", Type: "string"},
+	{Name: "nonce", Type: "string"},
+	{Name: "issuedAt", Type: "string"},
+	{Name: "expirationTime", Type: "string"},
+}
+
+func typedDataTypes(primaryType string) map[string][]TypedDataField {
+	return map[string][]TypedDataField{
+		typedDataDomainType: typedDataDomainFields,
+		primaryType:         typedDataAuthFields,
+	}
+}
+
+// NewTypedData renders m as primaryType typed data
+func NewTypedData(primaryType string, m *SiweMessage) *TypedData {
+	expirationTime := ""
+	if m.ExpirationTime != nil {
+		expirationTime = m.ExpirationTime.Format(time.RFC3339)
+	}
+
+	return &TypedData{
+		Types:       typedDataTypes(primaryType),
+		PrimaryType: primaryType,
+		Domain: TypedDataDomain{
+			Name:    typedDataName,
+			Version: typedDataVersion,
+			ChainId: m.ChainID,
+		},
+		Message: map[string]string{
+			"domain":         m.Domain,
+			"statement":      m.Statement,
+			"address":        m.Address,
+			"uri":            m.URI,
+			"nonce":          m.Nonce,
+			"issuedAt":       m.IssuedAt.Format(time.RFC3339),
+			"expirationTime": expirationTime,
+		},
+	}
+}
+
+// ParseTypedData rebuilds typed data signed by a wallet with the server side types and domain,
+// only the message values of td are taken over. The returned SiweMessage is used to validate them.
+func ParseTypedData(td *TypedData, primaryType string, chainID int64) (*TypedData, *SiweMessage, error) {
+	if td == nil || td.Message == nil {
+		return nil, nil, ErrTypedDataMalformed
+	}
+	if td.PrimaryType != primaryType {
+		return nil, nil, ErrTypedDataMalformed
+	}
+
+	message := make(map[string]string)
+	for _, f := range typedDataAuthFields {
+		v, ok := td.Message[f.Name]
+		if !ok {
+			return nil, nil, ErrTypedDataMalformed
+		}
+		message[f.Name] = v
+	}
+
+	m := &SiweMessage{
+		Domain:    message["domain"],
+		Address:   message["address"],
+		Statement: message["statement"],
+		URI:       message["uri"],
+		Version:   siweVersion,
+		ChainID:   chainID,
+		Nonce:     message["nonce"],
+	}
+	if !common.IsHexAddress(m.Address) {
+		return nil, nil, ErrTypedDataMalformed
+	}
+	issuedAt, err := time.Parse(time.RFC3339, message["issuedAt"])
+	if err != nil {
+		return nil, nil, ErrTypedDataMalformed
+	}
+	m.IssuedAt = issuedAt
+	expirationTime, err := time.Parse(time.RFC3339, message["expirationTime"])
+	if err != nil {
+		return nil, nil, ErrTypedDataMalformed
+	}
+	m.ExpirationTime = &expirationTime
+
+	return &TypedData{
+		Types:       typedDataTypes(primaryType),
+		PrimaryType: primaryType,
+		Domain: TypedDataDomain{
+			Name:    typedDataName,
+			Version: typedDataVersion,
+			ChainId: chainID,
+		},
+		Message: message,
+	}, m, nil
+}
+
+func encodeType(name string, fields []TypedDataField) string {
+	params := make([]string, 0, len(fields))
+	for _, f := range fields {
+		params = append(params, f.Type+" "+f.Name)
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(params, ","))
+}
+
+func encodeValue(t string, v string) ([]byte, error) {
+	switch t {
+	case "string":
+		return crypto.Keccak256([]byte(v)), nil
+	case "address":
+		if !common.IsHexAddress(v) {
+			return nil, ErrTypedDataMalformed
+		}
+		return common.LeftPadBytes(common.HexToAddress(v).Bytes(), 32), nil
+	case "uint256":
+		n, ok := new(big.Int).SetString(v, 10)
+		if !ok || n.Sign() < 0 {
+			return nil, ErrTypedDataMalformed
+		}
+		return math.U256Bytes(n), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+}
+
+func hashStruct(name string, fields []TypedDataField, values map[string]string) ([]byte, error) {
+	data := crypto.Keccak256([]byte(encodeType(name, fields)))
+	for _, f := range fields {
+		v, ok := values[f.Name]
+		if !ok {
+			return nil, ErrTypedDataMalformed
+		}
+		enc, err := encodeValue(f.Type, v)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, enc...)
+	}
+	return crypto.Keccak256(data), nil
+}
+
+// Hash returns keccak256("\x19\x01" ‖ domainSeparator ‖ hashStruct(message))
+func (td *TypedData) Hash() ([]byte, error) {
+	fields, ok := td.Types[td.PrimaryType]
+	if !ok {
+		return nil, ErrTypedDataMalformed
+	}
+
+	domainSeparator, err := hashStruct(typedDataDomainType, typedDataDomainFields, map[string]string{
+		"name":    td.Domain.Name,
+		"version": td.Domain.Version,
+		"chainId": fmt.Sprintf("%d", td.Domain.ChainId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	message, err := hashStruct(td.PrimaryType, fields, td.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := append([]byte("\x19\x01"), domainSeparator...)
+	raw = append(raw, message...)
+	return crypto.Keccak256(raw), nil
+}
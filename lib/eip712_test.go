@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+)
+
+// typedDataTestMessage is the sign in message of the signature below
+func typedDataTestMessage(t *testing.T) *SiweMessage {
+	t.Helper()
+
+	key, err := crypto.ToECDSA(crypto.Keccak256([]byte("eip712")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	expiration := issuedAt.Add(10 * time.Minute)
+	return &SiweMessage{
+		Domain:         "agile.example.com",
+		Address:        crypto.PubkeyToAddress(key.PublicKey).Hex(),
+		Statement:      "Sign in to Agile with this address.",
+		URI:            "https://agile.example.com",
+		Version:        siweVersion,
+		ChainID:        137,
+		Nonce:          "a1b2c3d4e5f6",
+		IssuedAt:       issuedAt,
+		ExpirationTime: &expiration,
+	}
+}
+
+// typedDataTestSignature is the eth_signTypedData_v4 signature of typedDataTestMessage as SignIn
+// by 0xd0E4E324Ad8555E43767b12b1C1f15EAa3e24e4e, the address of keccak256("eip712")
+const typedDataTestSignature = "0x27400187a33e90eb64c65359a5c9d0d5a352ee8266cac10ebb4b4183b0ba793c" +
+	"2f00bcb4c0e3d5c9d1ec1f43004bf2505f79f250fdd0ddd96b0546ea1a9861781c"
+
+func TestTypedDataHash(t *testing.T) {
+	td := NewTypedData(TypedDataSignIn, typedDataTestMessage(t))
+	hash, err := td.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same typed data hashed by go-ethereum
+	types := apitypes.Types{}
+	for name, fields := range td.Types {
+		for _, f := range fields {
+			types[name] = append(types[name], apitypes.Type{Name: f.Name, Type: f.Type})
+		}
+	}
+	message := apitypes.TypedDataMessage{}
+	for name, value := range td.Message {
+		message[name] = value
+	}
+	want, _, err := apitypes.TypedDataAndHash(apitypes.TypedData{
+		Types:       types,
+		PrimaryType: td.PrimaryType,
+		Domain: apitypes.TypedDataDomain{
+			Name:    td.Domain.Name,
+			Version: td.Domain.Version,
+			ChainId: math.NewHexOrDecimal256(td.Domain.ChainId),
+		},
+		Message: message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hash, want) {
+		t.Fatalf("hash %x, go-ethereum hashes %x", hash, want)
+	}
+
+	// every signed field changes the hash
+	for name := range td.Message {
+		changed := NewTypedData(TypedDataSignIn, typedDataTestMessage(t))
+		changed.Message[name] += "0"
+		if name == "address" {
+			changed.Message[name] = "0x0000000000000000000000000000000000000001"
+		}
+		other, err := changed.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(other, hash) {
+			t.Errorf("%s is not part of the hash", name)
+		}
+	}
+}
+
+func TestTypedDataRecover(t *testing.T) {
+	m := typedDataTestMessage(t)
+	sig, err := hexutil.Decode(typedDataTestSignature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what a wallet sends back, the server takes over only the message values
+	signed := NewTypedData(TypedDataSignIn, m)
+	signed.Domain.Name = "Other"
+	td, parsed, err := ParseTypedData(signed, TypedDataSignIn, m.ChainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.Verify(m.Domain, m.URI, m.ChainID, m.Address, m.Nonce, m.IssuedAt); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := td.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := RecoverHash(hash, append([]byte{}, sig...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Hex() != m.Address {
+		t.Errorf("recovered %s, want %s", address.Hex(), m.Address)
+	}
+
+	// signed for another chain or as another kind of message
+	for _, tc := range []struct {
+		primaryType string
+		chainID     int64
+	}{
+		{TypedDataSignIn, 1},
+		{TypedDataSignUp, m.ChainID},
+	} {
+		other := NewTypedData(tc.primaryType, m)
+		td, _, err := ParseTypedData(other, tc.primaryType, tc.chainID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := td.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		address, err := RecoverHash(hash, append([]byte{}, sig...))
+		if err == nil && address.Hex() == m.Address {
+			t.Errorf("signature of %s on chain %d accepted as %s on chain %d",
+				TypedDataSignIn, m.ChainID, tc.primaryType, tc.chainID)
+		}
+	}
+
+	if _, _, err := ParseTypedData(signed, TypedDataSignUp, m.ChainID); !errors.Is(err, ErrTypedDataMalformed) {
+		t.Errorf("sign in data parsed as sign up: %v", err)
+	}
+}
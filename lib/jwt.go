@@ -8,6 +8,10 @@ type JWTClaims struct {
 	UserEmail string   `json:"email,omitempty"`
 	UserRole  string   `json:"user_role,omitempty"`
 	MetaMasks []string `json:"meta_masks,omitempty"`
+	// refresh token family the token was issued for
+	Session string `json:"sid,omitempty"`
+	// iat in milliseconds, so that a revocation and a token issued within the same second are told apart
+	IssuedAtMs int64 `json:"iat_ms,omitempty"`
 
 	jwt.StandardClaims
 }
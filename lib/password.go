@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"errors"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordMinLength = 8
+	// bcrypt ignores everything after the 72nd byte
+	passwordMaxLength = 72
+)
+
+var (
+	ErrPasswordTooShort = errors.New("password must be at least 8 characters long")
+	ErrPasswordTooLong  = errors.New("password must be at most 72 bytes long")
+	ErrPasswordTooWeak  = errors.New("password must contain at least one letter and one digit")
+)
+
+// CheckPassword enforces the password policy:
+// 8-72 bytes, at least one letter and one digit.
+func CheckPassword(password string) error {
+	if len([]rune(password)) < passwordMinLength {
+		return ErrPasswordTooShort
+	}
+	if len(password) > passwordMaxLength {
+		return ErrPasswordTooLong
+	}
+
+	letter, digit := false, false
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return ErrPasswordTooWeak
+	}
+
+	return nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func ComparePassword(hash string, password string) bool {
+	if hash == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrInvalidPhone = errors.New("invalid phone number")
+
+	e164 = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+)
+
+// NormalizePhone converts a phone number as typed by a user into E.164 (+14155552671),
+// numbers without a country code get countryCode
+func NormalizePhone(phone string, countryCode string) (string, error) {
+	var b strings.Builder
+	for i, r := range strings.TrimSpace(phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+			// separators
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+
+	n := b.String()
+	switch {
+	case strings.HasPrefix(n, "+"):
+	case strings.HasPrefix(n, "00"):
+		// international call prefix
+		n = "+" + n[2:]
+	case countryCode == "1" && len(n) == 11 && strings.HasPrefix(n, "1"):
+		// north american numbers with the trunk prefix
+		n = "+" + n
+	default:
+		n = "+" + countryCode + strings.TrimPrefix(n, "0")
+	}
+
+	if !e164.MatchString(n) {
+		return "", ErrInvalidPhone
+	}
+	return n, nil
+}
@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/sha3"
+)
+
+func HasMatchingAddress(knownAddress string, recoveredAddress string) bool {
+	return strings.ToLower(knownAddress) == strings.ToLower(recoveredAddress)
+}
+
+func TextHash(data []byte) []byte {
+	hash, _ := TextAndHash(data)
+	return hash
+}
+
+func TextAndHash(data []byte) ([]byte, string) {
+	msg := fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(data), string(data))
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(msg))
+	return h.Sum(nil), msg
+}
+
+// RecoverHash returns the address for the account that signed hash, sig is modified in place
+func RecoverHash(hash []byte, sig hexutil.Bytes) (common.Address, error) {
+	if len(sig) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("signature must be %d bytes long", crypto.SignatureLength)
+	}
+	if sig[crypto.RecoveryIDOffset] != 27 && sig[crypto.RecoveryIDOffset] != 28 {
+		return common.Address{}, fmt.Errorf("invalid Ethereum signature (V is not 27 or 28)")
+	}
+	sig[crypto.RecoveryIDOffset] -= 27 // Transform yellow paper V from 27/28 to 0/1
+
+	rpk, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*rpk), nil
+}
+
+// NormalizeAddress is used wherever an address is part of a key
+func NormalizeAddress(address string) string {
+	return strings.ToLower(address)
+}
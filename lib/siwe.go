@@ -0,0 +1,255 @@
+package lib
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Sign-In with Ethereum, https://eips.ethereum.org/EIPS/eip-4361
+
+const (
+	siweHeader  = " wants you to sign in with your Ethereum account:"
+	siweVersion = "1"
+
+	siweURI            = "URI: "
+	siweVersionTag     = "Version: "
+	siweChainID        = "Chain ID: "
+	siweNonce          = "Nonce: "
+	siweIssuedAt       = "Issued At: "
+	siweExpirationTime = "Expiration Time: "
+	siweNotBefore      = "Not Before: "
+	siweRequestID      = "Request ID: "
+	siweResources      = "Resources:"
+)
+
+var (
+	ErrSiweMalformed = errors.New("malformed siwe message")
+	ErrSiweDomain    = errors.New("siwe domain mismatch")
+	ErrSiweURI       = errors.New("siwe uri mismatch")
+	ErrSiweVersion   = errors.New("unsupported siwe version")
+	ErrSiweChainID   = errors.New("siwe chain id mismatch")
+	ErrSiweAddress   = errors.New("siwe address mismatch")
+	ErrSiweNonce     = errors.New("siwe nonce mismatch")
+	ErrSiweIssuedAt  = errors.New("siwe message issued in the future")
+	ErrSiweExpired   = errors.New("siwe message expired")
+	ErrSiweNotBefore = errors.New("siwe message not yet valid")
+)
+
+// siweClockSkew tolerates small clock differences between wallet and server
+const siweClockSkew = time.Minute
+
+type SiweMessage struct {
+	Domain         string
+	Address        string
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        int64
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime *time.Time
+	NotBefore      *time.Time
+	RequestID      string
+	Resources      []string
+}
+
+// NewSiweMessage creates a message issued now and valid for expire
+func NewSiweMessage(domain, address, statement, uri string, chainID int64, nonce string, expire time.Duration) *SiweMessage {
+	now := time.Now().UTC().Truncate(time.Second)
+	expiration := now.Add(expire)
+
+	return &SiweMessage{
+		Domain:         domain,
+		Address:        common.HexToAddress(address).Hex(),
+		Statement:      statement,
+		URI:            uri,
+		Version:        siweVersion,
+		ChainID:        chainID,
+		Nonce:          nonce,
+		IssuedAt:       now,
+		ExpirationTime: &expiration,
+	}
+}
+
+func (m *SiweMessage) String() string {
+	var b strings.Builder
+
+	b.WriteString(m.Domain + siweHeader + "\n")
+	b.WriteString(m.Address + "\n")
+	b.WriteString("\n")
+	if m.Statement != "" {
+		b.WriteString(m.Statement + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString(siweURI + m.URI + "\n")
+	b.WriteString(siweVersionTag + m.Version + "\n")
+	b.WriteString(siweChainID + strconv.FormatInt(m.ChainID, 10) + "\n")
+	b.WriteString(siweNonce + m.Nonce + "\n")
+	b.WriteString(siweIssuedAt + m.IssuedAt.Format(time.RFC3339))
+	if m.ExpirationTime != nil {
+		b.WriteString("\n" + siweExpirationTime + m.ExpirationTime.Format(time.RFC3339))
+	}
+	if m.NotBefore != nil {
+		b.WriteString("\n" + siweNotBefore + m.NotBefore.Format(time.RFC3339))
+	}
+	if m.RequestID != "" {
+		b.WriteString("\n" + siweRequestID + m.RequestID)
+	}
+	if len(m.Resources) > 0 {
+		b.WriteString("\n" + siweResources)
+		for _, r := range m.Resources {
+			b.WriteString("\n- " + r)
+		}
+	}
+
+	return b.String()
+}
+
+func ParseSiweMessage(message string) (*SiweMessage, error) {
+	lines := strings.Split(message, "\n")
+	if len(lines) < 9 {
+		return nil, ErrSiweMalformed
+	}
+
+	m := &SiweMessage{}
+
+	// preamble
+	if !strings.HasSuffix(lines[0], siweHeader) {
+		return nil, ErrSiweMalformed
+	}
+	m.Domain = strings.TrimSuffix(lines[0], siweHeader)
+	if m.Domain == "" {
+		return nil, ErrSiweMalformed
+	}
+	m.Address = lines[1]
+	if !common.IsHexAddress(m.Address) || common.HexToAddress(m.Address).Hex() != m.Address {
+		// addresses must be EIP-55 checksummed
+		return nil, ErrSiweMalformed
+	}
+	if lines[2] != "" {
+		return nil, ErrSiweMalformed
+	}
+	i := 3
+	if lines[i] != "" {
+		m.Statement = lines[i]
+		i++
+		if lines[i] != "" {
+			return nil, ErrSiweMalformed
+		}
+	}
+	i++
+
+	// required fields
+	field := func(tag string) (string, error) {
+		if i >= len(lines) || !strings.HasPrefix(lines[i], tag) {
+			return "", ErrSiweMalformed
+		}
+		v := strings.TrimPrefix(lines[i], tag)
+		i++
+		return v, nil
+	}
+	var err error
+	if m.URI, err = field(siweURI); err != nil {
+		return nil, err
+	}
+	if m.Version, err = field(siweVersionTag); err != nil {
+		return nil, err
+	}
+	chainID, err := field(siweChainID)
+	if err != nil {
+		return nil, err
+	}
+	if m.ChainID, err = strconv.ParseInt(chainID, 10, 64); err != nil {
+		return nil, ErrSiweMalformed
+	}
+	if m.Nonce, err = field(siweNonce); err != nil {
+		return nil, err
+	}
+	if len(m.Nonce) < 8 {
+		return nil, ErrSiweMalformed
+	}
+	issuedAt, err := field(siweIssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if m.IssuedAt, err = time.Parse(time.RFC3339, issuedAt); err != nil {
+		return nil, ErrSiweMalformed
+	}
+
+	// optional fields
+	optional := func(tag string) (string, bool) {
+		if i < len(lines) && strings.HasPrefix(lines[i], tag) {
+			v := strings.TrimPrefix(lines[i], tag)
+			i++
+			return v, true
+		}
+		return "", false
+	}
+	if v, ok := optional(siweExpirationTime); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, ErrSiweMalformed
+		}
+		m.ExpirationTime = &t
+	}
+	if v, ok := optional(siweNotBefore); ok {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, ErrSiweMalformed
+		}
+		m.NotBefore = &t
+	}
+	if v, ok := optional(siweRequestID); ok {
+		m.RequestID = v
+	}
+	if i < len(lines) && lines[i] == siweResources {
+		i++
+		for ; i < len(lines) && strings.HasPrefix(lines[i], "- "); i++ {
+			m.Resources = append(m.Resources, strings.TrimPrefix(lines[i], "- "))
+		}
+	}
+	if i != len(lines) {
+		return nil, ErrSiweMalformed
+	}
+
+	return m, nil
+}
+
+// Verify checks every field of the message against what the server expects,
+// the signature itself is checked by the caller afterwards.
+// An expiration time is required.
+func (m *SiweMessage) Verify(domain, uri string, chainID int64, address, nonce string, now time.Time) error {
+	if m.Domain != domain {
+		return ErrSiweDomain
+	}
+	if m.URI != uri {
+		return ErrSiweURI
+	}
+	if m.Version != siweVersion {
+		return ErrSiweVersion
+	}
+	if m.ChainID != chainID {
+		return ErrSiweChainID
+	}
+	if !strings.EqualFold(m.Address, address) {
+		return ErrSiweAddress
+	}
+	if nonce == "" || m.Nonce != nonce {
+		return ErrSiweNonce
+	}
+	if m.IssuedAt.After(now.Add(siweClockSkew)) {
+		return ErrSiweIssuedAt
+	}
+	if m.ExpirationTime == nil || !now.Before(*m.ExpirationTime) {
+		return ErrSiweExpired
+	}
+	if m.NotBefore != nil && now.Add(siweClockSkew).Before(*m.NotBefore) {
+		return ErrSiweNotBefore
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	siweTestDomain  = "agile.example.com"
+	siweTestURI     = "https://agile.example.com"
+	siweTestAddress = "0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"
+	siweTestNonce   = "32891756"
+)
+
+// siweTestMessage is the example of EIP-4361 with every optional field
+const siweTestMessage = siweTestDomain + " wants you to sign in with your Ethereum account:\n" +
+	siweTestAddress + "\n" +
+	"\n" +
+	"I accept the ServiceOrg Terms of Service: https://service.org/tos\n" +
+	"\n" +
+	"URI: " + siweTestURI + "\n" +
+	"Version: 1\n" +
+	"Chain ID: 1\n" +
+	"Nonce: " + siweTestNonce + "\n" +
+	"Issued At: 2021-09-30T16:25:24Z\n" +
+	"Expiration Time: 2021-09-30T16:35:24Z\n" +
+	"Not Before: 2021-09-30T16:20:24Z\n" +
+	"Request ID: some-request\n" +
+	"Resources:\n" +
+	"- ipfs://bafybeiemxf5abjwjbikoz4mc3a3dla6ual3jsgpdr4cjr3oz3evfyavhwq/\n" +
+	"- https://example.com/my-web2-claim.json"
+
+func TestParseSiweMessage(t *testing.T) {
+	m, err := ParseSiweMessage(siweTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuedAt := time.Date(2021, 9, 30, 16, 25, 24, 0, time.UTC)
+	expiration := issuedAt.Add(10 * time.Minute)
+	notBefore := issuedAt.Add(-5 * time.Minute)
+	want := &SiweMessage{
+		Domain:         siweTestDomain,
+		Address:        siweTestAddress,
+		Statement:      "I accept the ServiceOrg Terms of Service: https://service.org/tos",
+		URI:            siweTestURI,
+		Version:        "1",
+		ChainID:        1,
+		Nonce:          siweTestNonce,
+		IssuedAt:       issuedAt,
+		ExpirationTime: &expiration,
+		NotBefore:      &notBefore,
+		RequestID:      "some-request",
+		Resources: []string{
+			"ipfs://bafybeiemxf5abjwjbikoz4mc3a3dla6ual3jsgpdr4cjr3oz3evfyavhwq/",
+			"https://example.com/my-web2-claim.json",
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("parsed %+v, want %+v", m, want)
+	}
+	if m.String() != siweTestMessage {
+		t.Errorf("String() = %q, want %q", m.String(), siweTestMessage)
+	}
+
+	// without a statement and the optional fields, as NewSiweMessage writes it
+	created := NewSiweMessage(siweTestDomain, siweTestAddress, "", siweTestURI, 5, siweTestNonce, time.Minute)
+	parsed, err := ParseSiweMessage(created.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, created) {
+		t.Errorf("parsed %+v, want %+v", parsed, created)
+	}
+}
+
+func TestParseSiweMessageMalformed(t *testing.T) {
+	replace := func(old, new string) string {
+		if !strings.Contains(siweTestMessage, old) {
+			t.Fatalf("%q not found", old)
+		}
+		return strings.Replace(siweTestMessage, old, new, 1)
+	}
+
+	for name, message := range map[string]string{
+		"empty":              "",
+		"truncated":          siweTestMessage[:strings.Index(siweTestMessage, "Nonce")],
+		"header":             replace(" wants you to sign in", " wants you to log in"),
+		"no domain":          replace(siweTestDomain+" wants", " wants"),
+		"address":            replace(siweTestAddress, "0xnotanaddress"),
+		"address checksum":   replace(siweTestAddress, strings.ToLower(siweTestAddress)),
+		"statement break":    replace("Service: https://service.org/tos\n", "Service:\nhttps://service.org/tos\n"),
+		"no blank line":      replace("tos\n\nURI", "tos\nURI"),
+		"missing uri":        replace("URI: "+siweTestURI+"\n", ""),
+		"field order":        replace("Version: 1\nChain ID: 1", "Chain ID: 1\nVersion: 1"),
+		"chain id":           replace("Chain ID: 1", "Chain ID: one"),
+		"short nonce":        replace("Nonce: "+siweTestNonce, "Nonce: 1234"),
+		"issued at":          replace("Issued At: 2021-09-30T16:25:24Z", "Issued At: yesterday"),
+		"expiration time":    replace("Expiration Time: 2021-09-30T16:35:24Z", "Expiration Time: 2021-09-30"),
+		"not before":         replace("Not Before: 2021-09-30T16:20:24Z", "Not Before: soon"),
+		"unknown field":      replace("Request ID: some-request", "Request: some-request"),
+		"trailing line":      siweTestMessage + "\n",
+		"resource no marker": replace("- https://example.com", "https://example.com"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseSiweMessage(message); !errors.Is(err, ErrSiweMalformed) {
+				t.Errorf("ParseSiweMessage = %v, want %v", err, ErrSiweMalformed)
+			}
+		})
+	}
+}
+
+func TestSiweMessageVerify(t *testing.T) {
+	m, err := ParseSiweMessage(siweTestMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := m.IssuedAt.Add(time.Minute)
+
+	for _, tc := range []struct {
+		name    string
+		domain  string
+		uri     string
+		chainID int64
+		address string
+		nonce   string
+		now     time.Time
+		want    error
+	}{
+		{"valid", siweTestDomain, siweTestURI, 1, siweTestAddress, siweTestNonce, now, nil},
+		{"address case", siweTestDomain, siweTestURI, 1, strings.ToLower(siweTestAddress), siweTestNonce, now, nil},
+		{"domain", "evil.example.com", siweTestURI, 1, siweTestAddress, siweTestNonce, now, ErrSiweDomain},
+		{"uri", siweTestDomain, "https://evil.example.com", 1, siweTestAddress, siweTestNonce, now, ErrSiweURI},
+		{"chain id", siweTestDomain, siweTestURI, 5, siweTestAddress, siweTestNonce, now, ErrSiweChainID},
+		{"address", siweTestDomain, siweTestURI, 1, "0x0000000000000000000000000000000000000001", siweTestNonce, now,
+			ErrSiweAddress},
+		{"nonce", siweTestDomain, siweTestURI, 1, siweTestAddress, "87654321", now, ErrSiweNonce},
+		{"no nonce", siweTestDomain, siweTestURI, 1, siweTestAddress, "", now, ErrSiweNonce},
+		{"issued in the future", siweTestDomain, siweTestURI, 1, siweTestAddress, siweTestNonce,
+			m.IssuedAt.Add(-2 * siweClockSkew), ErrSiweIssuedAt},
+		{"issued within the skew", siweTestDomain, siweTestURI, 1, siweTestAddress, siweTestNonce,
+			m.IssuedAt.Add(-siweClockSkew / 2), nil},
+		{"expired", siweTestDomain, siweTestURI, 1, siweTestAddress, siweTestNonce, *m.ExpirationTime,
+			ErrSiweExpired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := m.Verify(tc.domain, tc.uri, tc.chainID, tc.address, tc.nonce, tc.now)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Verify = %v, want %v", err, tc.want)
+			}
+		})
+	}
+
+	// messages valid later, without an expiration time or of another version are refused
+	later := *m
+	notBefore := now.Add(2 * siweClockSkew)
+	later.NotBefore = &notBefore
+	if err := later.Verify(siweTestDomain, siweTestURI, 1, siweTestAddress, siweTestNonce, now); !errors.Is(err, ErrSiweNotBefore) {
+		t.Errorf("Verify before not before = %v, want %v", err, ErrSiweNotBefore)
+	}
+	unbounded := *m
+	unbounded.ExpirationTime = nil
+	if err := unbounded.Verify(siweTestDomain, siweTestURI, 1, siweTestAddress, siweTestNonce, now); !errors.Is(err, ErrSiweExpired) {
+		t.Errorf("Verify without expiration time = %v, want %v", err, ErrSiweExpired)
+	}
+	other := *m
+	other.Version = "2"
+	if err := other.Verify(siweTestDomain, siweTestURI, 1, siweTestAddress, siweTestNonce, now); !errors.Is(err, ErrSiweVersion) {
+		t.Errorf("Verify of version 2 = %v, want %v", err, ErrSiweVersion)
+	}
+}
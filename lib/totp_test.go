@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 secret of RFC 6238, ASCII "12345678901234567890"
+const totpTestSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// the SHA1 test vectors of RFC 6238 appendix B, the codes are the last 6 of its 8 digits
+var totpTestVectors = []struct {
+	time int64
+	code string
+}{
+	{59, "287082"},          // 94287082
+	{1111111109, "081804"},  // 07081804
+	{1111111111, "050471"},  // 14050471
+	{1234567890, "005924"},  // 89005924
+	{2000000000, "279037"},  // 69279037
+	{20000000000, "353130"}, // 65353130
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range totpTestVectors {
+		code, err := TOTPCode(totpTestSecret, v.time/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != v.code {
+			t.Errorf("code at %d = %s, want %s", v.time, code, v.code)
+		}
+	}
+
+	if _, err := TOTPCode("not base32!", 1); err == nil {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	for _, v := range totpTestVectors {
+		now := time.Unix(v.time, 0)
+		counter, ok := VerifyTOTP(totpTestSecret, v.code, now)
+		if !ok || counter != v.time/totpPeriod {
+			t.Errorf("code at %d: %d, %v", v.time, counter, ok)
+		}
+		// secrets as users type them, codes with spaces around
+		if _, ok := VerifyTOTP(strings.ToLower(totpTestSecret), " "+v.code+"\n", now); !ok {
+			t.Errorf("code at %d not accepted with a lower case secret", v.time)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	for _, tc := range []struct {
+		name string
+		step int64
+		ok   bool
+	}{
+		{"previous", -1, true},
+		{"next", 1, true},
+		{"two before", -2, false},
+		{"two after", 2, false},
+	} {
+		code, err := TOTPCode(totpTestSecret, now.Unix()/totpPeriod+tc.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := VerifyTOTP(totpTestSecret, code, now); ok != tc.ok {
+			t.Errorf("%s code accepted: %v, want %v", tc.name, ok, tc.ok)
+		}
+	}
+
+	for _, code := range []string{"", "00592", "0005924", "abcdef"} {
+		if _, ok := VerifyTOTP(totpTestSecret, code, now); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI("Agile", "user@example.com", totpTestSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Agile:user@example.com" ||
+		query.Get("secret") != totpTestSecret || query.Get("issuer") != "Agile" ||
+		query.Get("algorithm") != "SHA1" || query.Get("digits") != "6" || query.Get("period") != "30" {
+		t.Errorf("unexpected uri %s", u)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := GenerateRecoveryCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 11 || code[5] != '-' {
+		t.Errorf("recovery code %q", code)
+	}
+	if NormalizeRecoveryCode(" "+strings.ToUpper(code[:5])+" "+code[6:]+" ") != code[:5]+code[6:] {
+		t.Errorf("typed recovery code not normalized")
+	}
+}
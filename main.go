@@ -15,13 +15,34 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/mylakehead/agile/api"
+	"github.com/mylakehead/agile/api/admin"
 	"github.com/mylakehead/agile/api/emails"
 	"github.com/mylakehead/agile/api/me"
 	"github.com/mylakehead/agile/api/metamask"
+	"github.com/mylakehead/agile/api/oauth"
 	"github.com/mylakehead/agile/api/users"
+	"github.com/mylakehead/agile/api/wellknown"
+	"github.com/mylakehead/agile/models"
 	"github.com/mylakehead/agile/runtime"
 )
 
+// rate limits of the routes which send messages or can be used to guess
+var (
+	existsLimit  = api.RateLimit{Name: "exists", Limit: 30, Window: time.Minute, By: api.RateLimitByIP}
+	messageLimit = api.RateLimit{Name: "message", Limit: 10, Window: time.Minute, By: api.RateLimitByIP}
+	// every request sends an email or a text message
+	verifyLimits = []api.RateLimit{
+		{Name: "verify/minute", Limit: 1, Window: time.Minute, By: api.RateLimitByIP},
+		{Name: "verify/hour", Limit: 10, Window: time.Hour, By: api.RateLimitByIP},
+	}
+	signInLimit  = api.RateLimit{Name: "sign-in", Limit: 10, Window: time.Minute, By: api.RateLimitByIP}
+	refreshLimit = api.RateLimit{Name: "refresh", Limit: 30, Window: time.Minute, By: api.RateLimitByIP}
+	// devices push predictions with API keys
+	predictionLimit = api.RateLimit{Name: "prediction", Limit: 60, Window: time.Minute, By: api.RateLimitByWallet}
+	// unsubscribe tokens are signed, this only keeps the database from being hammered
+	unsubscribeLimit = api.RateLimit{Name: "unsubscribe", Limit: 30, Window: time.Minute, By: api.RateLimitByIP}
+)
+
 func httpServer(rt *runtime.Runtime) *http.Server {
 	if rt.Config.Mode.Debug {
 		gin.SetMode(gin.DebugMode)
@@ -30,6 +51,9 @@ func httpServer(rt *runtime.Runtime) *http.Server {
 	}
 
 	router := gin.Default()
+	if err := router.SetTrustedProxies(rt.Config.HTTP.TrustedProxies); err != nil {
+		log.Fatalf("trusted proxies: %v", err)
+	}
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
@@ -43,20 +67,79 @@ func httpServer(rt *runtime.Runtime) *http.Server {
 	router.GET("/ping", func(ctx *gin.Context) {
 		ctx.JSON(http.StatusOK, nil)
 	})
+	router.GET("/.well-known/jwks.json", api.Wrap(wellknown.JWKS, rt, false, api.WithDataType(api.DataTypeJson)))
 
 	r := router.Group("/api")
 	{
-		r.GET("/exists/users/:name", api.Wrap(users.Exists, rt, false, api.WithDataType(api.DataTypeJson)))
-		r.GET("/exists/emails/:email", api.Wrap(emails.Exists, rt, false, api.WithDataType(api.DataTypeJson)))
-		r.GET("/exists/metamask/:address", api.Wrap(metamask.Exists, rt, false, api.WithDataType(api.DataTypeJson)))
-		r.GET("/metamask/:address/nonce", api.Wrap(metamask.Nonce, rt, false, api.WithDataType(api.DataTypeJson)))
-		r.POST("/verify/:type", api.Wrap(emails.Verify, rt, false, api.WithDataType(api.DataTypeJson)))
-		r.POST("/sign-up/:type", api.Wrap(users.SignUp, rt, false, api.WithDataType(api.DataTypeJson)))
-		r.POST("/sign-in/:type", api.Wrap(users.SignIn, rt, false, api.WithDataType(api.DataTypeJson)))
-
-		r.GET("/me/ongoing", api.Wrap(me.Ongoing, rt, true, api.WithDataType(api.DataTypeJson)))
-		r.GET("/me/prediction/:id", api.Wrap(me.GetPrediction, rt, true, api.WithDataType(api.DataTypeJson)))
-		r.POST("/me/prediction/:id", api.Wrap(me.UpdatePrediction, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.GET("/exists/users/:name", api.Wrap(users.Exists, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(existsLimit)))
+		r.GET("/exists/emails/:email", api.Wrap(emails.Exists, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(existsLimit)))
+		r.GET("/exists/metamask/:address", api.Wrap(metamask.Exists, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(existsLimit)))
+		r.GET("/metamask/:address/nonce", api.Wrap(metamask.Nonce, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(messageLimit)))
+		r.GET("/metamask/:address/message/:type", api.Wrap(metamask.Message, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(messageLimit)))
+		r.POST("/verify/:type", api.Wrap(emails.Verify, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(verifyLimits...)))
+		r.POST("/sign-up/:type", api.Wrap(users.SignUp, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(signInLimit)))
+		r.POST("/sign-in/:type", api.Wrap(users.SignIn, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(signInLimit)))
+		r.GET("/oauth/:provider/authorize", api.Wrap(oauth.Authorize, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(signInLimit)))
+		r.POST("/token/refresh", api.Wrap(users.Refresh, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(refreshLimit)))
+		r.POST("/password/forgot", api.Wrap(users.ForgotPassword, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(verifyLimits...)))
+		r.POST("/password/reset", api.Wrap(users.ResetPassword, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(signInLimit)))
+		r.GET("/unsubscribe/:token", api.Wrap(emails.UnsubscribeStatus, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(unsubscribeLimit)))
+		r.POST("/unsubscribe/:token", api.Wrap(emails.Unsubscribe, rt, false, api.WithDataType(api.DataTypeJson),
+			api.WithRateLimit(unsubscribeLimit)))
+		r.POST("/sign-out", api.Wrap(users.SignOut, rt, true, api.WithDataType(api.DataTypeJson)))
+
+		r.GET("/me/ongoing", api.Wrap(me.Ongoing, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithScopes(models.ScopeTradesRead)))
+		r.GET("/me/prediction/:id", api.Wrap(me.GetPrediction, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithScopes(models.ScopePredictionRead)))
+		r.POST("/me/prediction/:id", api.Wrap(me.UpdatePrediction, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithScopes(models.ScopePredictionWrite), api.WithRateLimit(predictionLimit)))
+		r.GET("/me/metamasks", api.Wrap(me.ListMetaMasks, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.POST("/me/metamasks", api.Wrap(me.LinkMetaMask, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.GET("/me/metamasks/:address/message", api.Wrap(me.LinkMetaMaskMessage, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.PUT("/me/metamasks/:address/primary", api.Wrap(me.SetPrimaryMetaMask, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.DELETE("/me/metamasks/:address", api.Wrap(me.UnlinkMetaMask, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.GET("/me/2fa", api.Wrap(me.TwoFactor, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.POST("/me/2fa/totp", api.Wrap(me.EnrollTOTP, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.POST("/me/2fa/totp/confirm", api.Wrap(me.ConfirmTOTP, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.DELETE("/me/2fa/totp", api.Wrap(me.DisableTOTP, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.POST("/me/2fa/recovery-codes", api.Wrap(me.RegenerateRecoveryCodes, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.GET("/me/sessions", api.Wrap(me.ListSessions, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.DELETE("/me/sessions", api.Wrap(me.RevokeOtherSessions, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.DELETE("/me/sessions/:id", api.Wrap(me.RevokeSession, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.GET("/me/api-keys", api.Wrap(me.ListAPIKeys, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.POST("/me/api-keys", api.Wrap(me.CreateAPIKey, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.DELETE("/me/api-keys/:id", api.Wrap(me.RevokeAPIKey, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.GET("/me/export", api.Wrap(me.Export, rt, true, api.WithDataType(api.DataTypeAttachment)))
+		r.DELETE("/me", api.Wrap(me.DeleteAccount, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.GET("/me/notifications", api.Wrap(me.GetNotifications, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.PUT("/me/notifications", api.Wrap(me.UpdateNotifications, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.PUT("/me/locale", api.Wrap(me.SetLocale, rt, true, api.WithDataType(api.DataTypeJson)))
+		r.POST("/me/restore", api.Wrap(me.RestoreAccount, rt, true, api.WithDataType(api.DataTypeJson)))
+
+		r.POST("/admin/users/:id/revoke", api.Wrap(admin.RevokeUser, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithPermissions(models.PermissionTokensRevoke)))
+		r.POST("/admin/users/:id/2fa/reset", api.Wrap(admin.ResetTwoFactor, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithPermissions(models.PermissionTwoFactorReset)))
+		r.POST("/admin/announcements", api.Wrap(admin.Announce, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithPermissions(models.PermissionAnnounce)))
+		r.GET("/admin/emails", api.Wrap(admin.ListEmails, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithPermissions(models.PermissionEmailsManage)))
+		r.GET("/admin/emails/:id", api.Wrap(admin.GetEmail, rt, true, api.WithDataType(api.DataTypeJson),
+			api.WithPermissions(models.PermissionEmailsManage)))
 	}
 
 	addr := fmt.Sprintf("%s:%d", rt.Config.HTTP.Host, rt.Config.HTTP.Port)
@@ -72,9 +155,38 @@ func grpcServer(_ *runtime.Runtime) *http.Server {
 	return nil
 }
 
-func onExit(rt *runtime.Runtime, httpServer *http.Server) {
+// housekeeping deletes the accounts whose deletion grace period is over, expired sessions
+// and the outbox emails past their retention, once an hour until ctx is done
+func housekeeping(ctx context.Context, rt *runtime.Runtime) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		count, err := api.PurgeDeletedUsers(rt)
+		if err != nil {
+			log.Printf("purge deleted users: %v", err)
+		} else if count > 0 {
+			log.Printf("purged %d deleted users", count)
+		}
+		if _, err := api.PurgeExpiredSessions(rt); err != nil {
+			log.Printf("purge expired sessions: %v", err)
+		}
+		if _, err := rt.Email.Outbox.Purge(); err != nil {
+			log.Printf("purge outbox: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// onExit shuts down on a signal, stop ends the background jobs before the runtime closes their clients
+func onExit(rt *runtime.Runtime, httpServer *http.Server, stop func()) {
 	// Wait for interrupt signal to gracefully shut down
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	defer close(quit)
 	// kill (no param) default send syscall.SIGTERM
 	// kill -2 is syscall.SIGINT
@@ -101,6 +213,8 @@ func onExit(rt *runtime.Runtime, httpServer *http.Server) {
 		}
 	}
 
+	stop()
+
 	// shutdown the runtime with a timeout of 5 seconds
 	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -143,9 +257,18 @@ func main() {
 	}()
 
 	_ = grpcServer(rt)
+	ctx, stopHousekeeping := context.WithCancel(context.Background())
+	housekept := make(chan struct{})
+	go func() {
+		defer close(housekept)
+		housekeeping(ctx, rt)
+	}()
 	go func() {
 		return
 	}()
 
-	onExit(rt, hs)
+	onExit(rt, hs, func() {
+		stopHousekeeping()
+		<-housekept
+	})
 }
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Scope is what an API key may be used for
+type Scope string
+
+const (
+	ScopePredictionRead  Scope = "prediction:read"
+	ScopePredictionWrite Scope = "prediction:write"
+	ScopeTradesRead      Scope = "trades:read"
+)
+
+var Scopes = []Scope{
+	ScopePredictionRead,
+	ScopePredictionWrite,
+	ScopeTradesRead,
+}
+
+// APIKey lets devices such as smart meters act for a user without signing in, only its hash is kept
+type APIKey struct {
+	Model
+	UserID uint `gorm:"index;not null"`
+
+	Name string `json:"name" gorm:"type:varchar(64);not null"`
+	// first characters of the key, to tell keys apart
+	Prefix string `json:"prefix" gorm:"type:varchar(16);not null"`
+	Hash   string `json:"-" gorm:"type:varchar(64);uniqueIndex;not null"`
+	// comma separated
+	Scopes     string     `json:"scopes" gorm:"type:varchar(255);not null"`
+	ExpireAt   *time.Time `json:"expire_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
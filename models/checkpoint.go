@@ -0,0 +1,15 @@
+package models
+
+// ChainCheckpoint is a block an indexer has processed up to, the latest ones are kept
+// to find where the chain forked after a reorg
+type ChainCheckpoint struct {
+	Model
+
+	Indexer string `json:"indexer" gorm:"type:varchar(64);uniqueIndex:idx_checkpoint_block;not null"`
+	Number  uint64 `json:"number" gorm:"uniqueIndex:idx_checkpoint_block;not null"`
+	Hash    string `json:"hash" gorm:"type:varchar(66);not null"`
+}
+
+func (ChainCheckpoint) TableName() string {
+	return "chain_checkpoint"
+}
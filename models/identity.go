@@ -0,0 +1,12 @@
+package models
+
+// ExternalIdentity links a user to an account at an OAuth2/OIDC provider
+type ExternalIdentity struct {
+	Model
+	UserID uint `gorm:"index;not null"`
+
+	Provider string `json:"provider" gorm:"type:varchar(32);uniqueIndex:idx_provider_subject;not null"`
+	Subject  string `json:"subject" gorm:"type:varchar(255);uniqueIndex:idx_provider_subject;not null"`
+	Email    string `json:"email" gorm:"type:varchar(320)"`
+	Name     string `json:"name" gorm:"type:varchar(255)"`
+}
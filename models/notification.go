@@ -0,0 +1,65 @@
+package models
+
+// Notification is a kind of email a user may opt out of, transactional emails such as captchas are always sent
+type Notification string
+
+const (
+	NotificationTradeConfirmations Notification = "trade_confirmations"
+	NotificationWeeklySummaries    Notification = "weekly_summaries"
+	NotificationAnnouncements      Notification = "announcements"
+)
+
+var Notifications = []Notification{
+	NotificationTradeConfirmations,
+	NotificationWeeklySummaries,
+	NotificationAnnouncements,
+}
+
+// NotificationPreferences of a user, every notification is on while the user has none stored
+type NotificationPreferences struct {
+	Model
+	UserID uint `json:"-" gorm:"uniqueIndex;not null"`
+
+	// no default tags, gorm would insert the default instead of false
+	TradeConfirmations bool `json:"trade_confirmations" gorm:"not null"`
+	WeeklySummaries    bool `json:"weekly_summaries" gorm:"not null"`
+	Announcements      bool `json:"announcements" gorm:"not null"`
+}
+
+func DefaultNotificationPreferences(userID uint) NotificationPreferences {
+	return NotificationPreferences{
+		UserID:             userID,
+		TradeConfirmations: true,
+		WeeklySummaries:    true,
+		Announcements:      true,
+	}
+}
+
+// Enabled tells whether n is sent, false for unknown notifications
+func (p *NotificationPreferences) Enabled(n Notification) bool {
+	switch n {
+	case NotificationTradeConfirmations:
+		return p.TradeConfirmations
+	case NotificationWeeklySummaries:
+		return p.WeeklySummaries
+	case NotificationAnnouncements:
+		return p.Announcements
+	default:
+		return false
+	}
+}
+
+// Set turns n on or off, false for unknown notifications
+func (p *NotificationPreferences) Set(n Notification, on bool) bool {
+	switch n {
+	case NotificationTradeConfirmations:
+		p.TradeConfirmations = on
+	case NotificationWeeklySummaries:
+		p.WeeklySummaries = on
+	case NotificationAnnouncements:
+		p.Announcements = on
+	default:
+		return false
+	}
+	return true
+}
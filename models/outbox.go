@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+type OutboxStatus string
+
+const (
+	OutboxPending OutboxStatus = "pending"
+	OutboxSent    OutboxStatus = "sent"
+	// gave up after the last attempt, kept for inspection
+	OutboxFailed OutboxStatus = "failed"
+)
+
+// OutboxEmail is an email waiting to be, or having been, delivered by the runtime outbox
+type OutboxEmail struct {
+	Model
+
+	From    string `json:"from" gorm:"type:varchar(320);not null"`
+	To      string `json:"to" gorm:"type:varchar(320);index;not null"`
+	Subject string `json:"subject" gorm:"type:varchar(255)"`
+	// the complete message, headers included, emptied once sent or failed
+	Message []byte `json:"-" gorm:"type:mediumblob;not null"`
+
+	Status        string     `json:"status" gorm:"type:varchar(16);index:idx_outbox_due;not null"`
+	Attempts      int        `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"index:idx_outbox_due;not null"`
+	LockedUntil   *time.Time `json:"-"`
+	LastError     string     `json:"last_error" gorm:"type:text"`
+	SentAt        *time.Time `json:"sent_at"`
+}
+
+func (OutboxEmail) TableName() string {
+	return "outbox_email"
+}
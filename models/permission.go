@@ -0,0 +1,27 @@
+package models
+
+type Permission string
+
+const (
+	PermissionTokensRevoke   Permission = "tokens:revoke"
+	PermissionTwoFactorReset Permission = "2fa:reset"
+	PermissionEmailsManage   Permission = "emails:manage"
+	PermissionAnnounce       Permission = "announcements:send"
+)
+
+// DefaultRolePermissions are seeded when migrating, further grants are made in the table
+var DefaultRolePermissions = map[Role][]Permission{
+	RoleAdmin: {
+		PermissionTokensRevoke,
+		PermissionTwoFactorReset,
+		PermissionEmailsManage,
+		PermissionAnnounce,
+	},
+}
+
+type RolePermission struct {
+	Model
+
+	Role       string `json:"role" gorm:"type:varchar(64);uniqueIndex:idx_role_permission;not null"`
+	Permission string `json:"permission" gorm:"type:varchar(64);uniqueIndex:idx_role_permission;not null"`
+}
@@ -11,6 +11,11 @@ type Purchased struct {
 	Amount float64 `json:"amount" gorm:"type:decimal(20,2);not null"`
 
 	Timestamp uint64 `json:"timestamp" gorm:"not null"`
+
+	// where the indexer found the purchase event, zero for rows written before it
+	ChainBlock uint64 `json:"chain_block" gorm:"index;not null;default:0"`
+	TxHash     string `json:"tx_hash" gorm:"type:varchar(66)"`
+	LogIndex   uint   `json:"log_index" gorm:"not null;default:0"`
 }
 
 func (Purchased) TableName() string {
@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Session is a sign-in of a user on a device, it lasts as long as its refresh token family
+type Session struct {
+	Model
+	UserID uint `gorm:"index;not null"`
+
+	// refresh token family, also the sid claim of its access tokens
+	Family     string    `json:"-" gorm:"type:varchar(32);uniqueIndex;not null"`
+	IP         string    `json:"ip" gorm:"type:varchar(45)"`
+	UserAgent  string    `json:"user_agent" gorm:"type:varchar(255)"`
+	LastSeenAt time.Time `json:"last_seen_at" gorm:"index;not null"`
+}
@@ -0,0 +1,24 @@
+package models
+
+// TOTP is the authenticator app of a user, it is only used once Confirmed
+type TOTP struct {
+	Model
+	UserID uint `gorm:"uniqueIndex;not null"`
+
+	Secret    string `json:"-" gorm:"type:varchar(64);not null"`
+	Confirmed bool   `json:"confirmed" gorm:"not null;default:false"`
+	// time step of the last accepted code, a code is accepted once
+	LastCounter int64 `json:"-" gorm:"not null;default:0"`
+}
+
+func (TOTP) TableName() string {
+	return "totp"
+}
+
+type RecoveryCode struct {
+	Model
+	UserID uint `gorm:"index;not null"`
+
+	Hash string `json:"-" gorm:"type:varchar(64);not null"`
+	Used bool   `json:"used" gorm:"not null;default:false"`
+}
@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type Role string
 
 const (
@@ -10,11 +12,26 @@ const (
 type User struct {
 	Model
 
-	Name      string     `json:"name" gorm:"type:varchar(64);unique;not null"`
-	Email     string     `json:"email" gorm:"type:varchar(320);unique"`
-	Password  string     `json:"password" gorm:"type:varchar(64)"`
-	Role      string     `json:"role" gorm:"type:varchar(64);not null"`
+	Name     string `json:"name" gorm:"type:varchar(64);unique;not null"`
+	Email    string `json:"email" gorm:"type:varchar(320);unique;default:null"`
+	Phone    string `json:"phone" gorm:"type:varchar(16);unique;default:null"`
+	Password string `json:"-" gorm:"type:varchar(64)"`
+	Role     string `json:"role" gorm:"type:varchar(64);not null"`
+	// of the emails sent to the user, one of the locales of the email templates
+	Locale    string     `json:"locale" gorm:"type:varchar(35)"`
 	MetaMasks []MetaMask `json:"meta_masks" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	Identities []ExternalIdentity `json:"identities" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	TOTP          *TOTP          `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	RecoveryCodes []RecoveryCode `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	Sessions      []Session      `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+	APIKeys       []APIKey       `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	Notifications *NotificationPreferences `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE"`
+
+	// the account is deleted at this time unless restored before, nil if not asked for
+	DeleteAt *time.Time `json:"-" gorm:"index"`
 }
 
 type MetaMask struct {
@@ -22,5 +39,7 @@ type MetaMask struct {
 	UserID uint
 
 	Address string `json:"address" gorm:"type:varchar(64);unique;not null"`
-	Nonce   string `json:"nonce" gorm:"type:varchar(8);not null"`
+	// no longer used, sign in nonces are issued per message, see api.SiweSignInNonceKey
+	Nonce   string `json:"-" gorm:"type:varchar(8);not null"`
+	Primary bool   `json:"primary" gorm:"column:is_primary;not null;default:false"`
 }
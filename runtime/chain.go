@@ -0,0 +1,57 @@
+package runtime
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// ChainClient is the part of an ethereum client the service needs.
+// It is satisfied by *ethclient.Client and by the client of go-ethereum's simulated backend,
+// which is how it is swapped out in tests.
+type ChainClient interface {
+	CodeAt(ctx context.Context, account common.Address, blockNumber *big.Int) ([]byte, error)
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+
+	// used by the indexer
+	BlockNumber(ctx context.Context) (uint64, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+type Chain struct {
+	Cli ChainClient
+}
+
+func NewChain(cli ChainClient) *Chain {
+	return &Chain{Cli: cli}
+}
+
+// newChain dials [chain] rpc, there is no chain if it is not configured
+func newChain(config *Config) (*Chain, error) {
+	if config.Chain.RPC == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	cli, err := ethclient.DialContext(ctx, config.Chain.RPC)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewChain(cli), nil
+}
+
+func (c *Chain) Close() {
+	// the simulated backend is closed by its owner
+	if closer, ok := c.Cli.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"os"
+	"time"
 
 	"github.com/pelletier/go-toml/v2"
 )
@@ -16,6 +17,8 @@ type HTTP struct {
 	TLS  bool
 	Crt  string
 	Key  string
+	// proxies whose X-Forwarded-For is believed, the client IP keys rate limits and sessions
+	TrustedProxies []string
 }
 
 type MysqlConfig struct {
@@ -41,25 +44,110 @@ type RedisConfig struct {
 }
 
 type EmailConfig struct {
-	Host     string
-	Port     int
+	// smtp, maildir, file or log
+	Transport string
+	Host      string
+	Port      int
+	// starttls, implicit or none
+	TLS      string
 	From     string
+	FromName string
+	// defaults to From
+	Username string
 	Password string
-	Template string
+	// where the maildir and file transports deliver to
+	Dir string
+	// one directory per kind of email, with one directory per locale in it
+	Templates string
+	// used when the locale of the recipient is not translated to
+	DefaultLocale string
+	// captchas sent by email or text message
+	CaptchaLength int
+	// seconds a captcha is valid
+	CaptchaExpire int64
+	// failed attempts after which a captcha is invalidated
+	CaptchaAttempts int
+	// seconds before another captcha is sent to the same address
+	CaptchaCooldown int64
+	// HMAC-SHA256 key captchas are kept hashed with
+	CaptchaKey string
+	// the link of the password reset email is ResetURL?token=<token>
+	ResetURL string
+	// seconds a reset link is valid
+	ResetExpire int64
+	// outbox workers delivering in parallel
+	Workers int
+	// delivery attempts before a message is failed
+	MaxAttempts int
+	// seconds sent and failed messages are kept in the outbox
+	OutboxRetention int64
+	// signs the unsubscribe tokens of notifications, whose links are UnsubscribeURL<token>
+	UnsubscribeKey string
+	UnsubscribeURL string
+	// seconds an unsubscribe link is valid
+	UnsubscribeMaxAge int64
+	// messages are not signed without a key file
+	DKIM DKIMConfig
+}
+
+type SMSConfig struct {
+	Transport   string
+	File        string
+	CountryCode string
 }
 
 type JWT struct {
-	Expire int
-	Key    string
+	Expire        int
+	RefreshExpire int
+	// HS256 shared secret, leave empty once every token is signed with a key pair
+	Key string
+	// with a signing key, tokens signed with Key are accepted until then, to migrate without signing everyone out
+	KeyAcceptedUntil time.Time
+	SigningKey       string
+	Keys             []JWTKeyConfig
+}
+
+type SiweConfig struct {
+	Domain  string
+	URI     string
+	ChainID int64
+	Expire  int
+}
+
+type ChainConfig struct {
+	RPC string
+	// purchases of the market contract are indexed if set
+	Market string
+	// ABI file of the market contract, a bare array or a build artifact with an "abi" field
+	MarketABI  string
+	StartBlock uint64
+	// blocks on top of a block before it is indexed
+	Confirmations uint64
+	// blocks read at once
+	Batch uint64
+	// seconds between polls once caught up
+	Interval int64
+	// of the purchased amounts, 2 if left out
+	AmountDecimals *int
+}
+
+type AccountConfig struct {
+	// seconds between asking to delete an account and deleting it, it can be restored until then
+	DeletionGrace int64
 }
 
 type Config struct {
-	Mode  Mode
-	HTTP  HTTP
-	Mysql MysqlConfig
-	Redis RedisConfig
-	Email EmailConfig
-	Jwt   JWT
+	Mode    Mode
+	HTTP    HTTP
+	Mysql   MysqlConfig
+	Redis   RedisConfig
+	Email   EmailConfig
+	SMS     SMSConfig
+	Jwt     JWT
+	Siwe    SiweConfig
+	Chain   ChainConfig
+	Account AccountConfig
+	OAuth   map[string]OAuthProviderConfig
 }
 
 func loadConfig(configFile string) (*Config, error) {
@@ -0,0 +1,226 @@
+package runtime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+outgoing mail is signed with DKIM (RFC 6376) when [email.dkim] is configured,
+with relaxed/relaxed canonicalization and rsa-sha256 or ed25519-sha256 (RFC 8463) depending on the key.
+the public key is published as a TXT record at <selector>._domainkey.<domain>:
+
+	v=DKIM1; k=rsa; p=<base64 of the DER public key>
+	v=DKIM1; k=ed25519; p=<base64 of the 32 bytes public key>
+*/
+
+type DKIMConfig struct {
+	Domain   string
+	Selector string
+	// PEM, an RSA or Ed25519 private key
+	File string
+}
+
+// the headers signed if the message has them, from is listed twice so that no other From can be added
+var dkimHeaders = []string{
+	"From", "From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type",
+	// one-click unsubscribe needs them signed (RFC 8058 4)
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+type DKIMSigner struct {
+	domain    string
+	selector  string
+	algorithm string
+	key       crypto.Signer
+}
+
+func newDKIMSigner(config *Config) (*DKIMSigner, error) {
+	c := config.Email.DKIM
+	if c.File == "" {
+		return nil, nil
+	}
+	if c.Domain == "" || c.Selector == "" {
+		return nil, errors.New("dkim domain and selector are required")
+	}
+
+	content, err := os.ReadFile(c.File)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("dkim key: no PEM data")
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("dkim key: unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DKIMSigner{domain: c.Domain, selector: c.Selector}
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		s.algorithm = "rsa-sha256"
+		s.key = key
+	case ed25519.PrivateKey:
+		s.algorithm = "ed25519-sha256"
+		s.key = key
+	default:
+		return nil, errors.New("dkim key: neither RSA nor Ed25519")
+	}
+
+	return s, nil
+}
+
+// relaxedHeader canonicalizes a header field, given as "Name: value" possibly folded, without the CRLF
+func relaxedHeader(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	value = strings.Join(strings.Fields(value), " ")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+// relaxedBody canonicalizes the body, whitespace is collapsed and empty lines at the end are dropped
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+
+	var buf bytes.Buffer
+	empty := 0
+	for _, line := range lines {
+		var b strings.Builder
+		space := false
+		for _, r := range line {
+			if r == ' ' || r == '\t' {
+				space = true
+				continue
+			}
+			// whitespace at the end of a line is dropped, elsewhere reduced to a single space
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteRune(r)
+		}
+
+		if b.Len() == 0 {
+			empty++
+			continue
+		}
+		for ; empty > 0; empty-- {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(b.String())
+		buf.WriteString("\r\n")
+	}
+
+	return buf.Bytes()
+}
+
+// splitHeader returns the header fields of msg, each with its continuation lines, and the body
+func splitHeader(msg []byte) ([]string, []byte, error) {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, nil, errors.New("message without body")
+	}
+
+	var fields []string
+	for _, line := range strings.Split(string(msg[:i]), "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	return fields, msg[i+4:], nil
+}
+
+// Sign returns msg with a DKIM-Signature header in front
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	fields, body, err := splitHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	// a header listed more often than it occurs signs its absence, which is what keeps another From out
+	var names []string
+	var signed bytes.Buffer
+	used := make(map[string]int)
+	for _, name := range dkimHeaders {
+		lower := strings.ToLower(name)
+		// the last occurrence not signed yet, per RFC 6376 5.4.2
+		var found []string
+		for _, field := range fields {
+			n, _, _ := strings.Cut(field, ":")
+			if strings.EqualFold(strings.TrimSpace(n), name) {
+				found = append(found, field)
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		names = append(names, lower)
+		if used[lower] < len(found) {
+			signed.WriteString(relaxedHeader(found[len(found)-1-used[lower]]))
+			signed.WriteString("\r\n")
+		}
+		used[lower]++
+	}
+
+	header := fmt.Sprintf(
+		"DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.algorithm, s.domain, s.selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
+	signed.WriteString(relaxedHeader(header))
+	digest := sha256.Sum256(signed.Bytes())
+
+	var signature []byte
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		// ed25519-sha256 signs the hash with pure Ed25519
+		signature = ed25519.Sign(key, digest[:])
+	default:
+		signature, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(header)
+	b := base64.StdEncoding.EncodeToString(signature)
+	for len(b) > 64 {
+		out.WriteString(b[:64])
+		out.WriteString("\r\n\t")
+		b = b[64:]
+	}
+	out.WriteString(b)
+	out.WriteString("\r\n")
+	out.Write(msg)
+
+	return out.Bytes(), nil
+}
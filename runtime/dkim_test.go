@@ -0,0 +1,181 @@
+package runtime
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const (
+	dkimTestDomain   = "example.com"
+	dkimTestSelector = "agile"
+)
+
+// a folded header and trailing blank lines, which relaxed canonicalization has to handle
+const dkimTestMessage = "From: Agile Group <noreply@example.com>\r\n" +
+	"To: <user@example.org>\r\n" +
+	"Subject: a subject\r\n" +
+	"\tfolded  onto  a second line\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"Message-ID: <1.abc@example.com>\r\n" +
+	"X-Unsigned: not in the list\r\n" +
+	"\r\n" +
+	"Hello  \t world \r\n" +
+	"\r\n" +
+	"second paragraph\r\n" +
+	"\r\n" +
+	"\r\n" +
+	"\r\n"
+
+// newTestDKIMSigner loads key the way the runtime does, it returns the signer and its TXT record
+func newTestDKIMSigner(t *testing.T, key crypto.Signer) (*DKIMSigner, string) {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "dkim.pem")
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{}
+	config.Email.DKIM = DKIMConfig{Domain: dkimTestDomain, Selector: dkimTestSelector, File: file}
+	signer, err := newDKIMSigner(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record string
+	switch public := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)
+	}
+	return signer, record
+}
+
+// verifyDKIM checks the signatures of msg with go-msgauth, resolving the selector to record
+func verifyDKIM(t *testing.T, msg []byte, record string) error {
+	t.Helper()
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != dkimTestSelector+"._domainkey."+dkimTestDomain {
+				return nil, fmt.Errorf("no TXT record for %s", domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("%d signatures, want 1", len(verifications))
+	}
+	if verifications[0].Err == nil && verifications[0].Domain != dkimTestDomain {
+		t.Fatalf("signed for %s, want %s", verifications[0].Domain, dkimTestDomain)
+	}
+	return verifications[0].Err
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": ed25519Key} {
+		t.Run(name, func(t *testing.T) {
+			signer, record := newTestDKIMSigner(t, key)
+			if signer.algorithm != name {
+				t.Fatalf("algorithm %s, want %s", signer.algorithm, name)
+			}
+
+			signed, err := signer.Sign([]byte(dkimTestMessage))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyDKIM(t, signed, record); err != nil {
+				t.Fatalf("valid signature rejected: %v", err)
+			}
+
+			// what relaxed canonicalization ignores
+			refolded := bytes.Replace(signed, []byte("Subject: a subject\r\n\tfolded"), []byte("Subject:  a subject\r\n folded"), 1)
+			if bytes.Equal(refolded, signed) {
+				t.Fatal("subject not found")
+			}
+			if err := verifyDKIM(t, append(refolded, "\r\n\r\n"...), record); err != nil {
+				t.Errorf("refolded message with more trailing blank lines rejected: %v", err)
+			}
+
+			tampered := map[string][]byte{
+				"subject":    bytes.Replace(signed, []byte("second line"), []byte("third line"), 1),
+				"body":       bytes.Replace(signed, []byte("second paragraph"), []byte("other paragraph"), 1),
+				"added body": append(append([]byte{}, signed...), "more\r\n"...),
+				// From is signed twice, so that another one cannot be added
+				"second from": bytes.Replace(signed, []byte("From: Agile"),
+					[]byte("From: <attacker@example.net>\r\nFrom: Agile"), 1),
+			}
+			for what, msg := range tampered {
+				if bytes.Equal(msg, signed) {
+					t.Fatalf("%s not found", what)
+				}
+				if err := verifyDKIM(t, msg, record); err == nil {
+					t.Errorf("%s changed after signing, signature accepted", what)
+				}
+			}
+		})
+	}
+}
+
+func TestDKIMCompose(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, record := newTestDKIMSigner(t, key)
+
+	e := &Email{From: "noreply@" + dkimTestDomain, FromName: defaultEmailFromName, DKIM: signer}
+	msg, err := e.compose("user@example.org", "Bienvenue à Agile, une ligne assez longue pour être repliée",
+		map[string]string{
+			"List-Unsubscribe":      "<https://agile.example.com/api/unsubscribe/token>",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+		[]byte("text  part\n\n\n"), []byte("<p>html part</p>\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, _, _ := strings.Cut(string(msg), "\r\n\r\n")
+	if !strings.Contains(header, "h=from:from:to:subject:date:message-id:mime-version:content-type:"+
+		"list-unsubscribe:list-unsubscribe-post;") {
+		t.Errorf("unexpected signed headers in %s", header)
+	}
+	if err := verifyDKIM(t, msg, record); err != nil {
+		t.Errorf("composed message rejected: %v", err)
+	}
+}
@@ -2,106 +2,263 @@ package runtime
 
 import (
 	"bytes"
-	"crypto/tls"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"net"
-	"net/smtp"
-	"text/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/models"
+)
+
+const (
+	defaultEmailFromName          = "Agile Group"
+	defaultEmailUnsubscribeMaxAge = 180 * 24 * time.Hour
 )
 
 type Email struct {
-	Host     string
-	Port     int
-	From     string
-	Password string
-	Server   string
-	Template *template.Template
+	From      string
+	FromName  string
+	Outbox    *Outbox
+	Templates *EmailTemplates
+	// nil if messages are not signed
+	DKIM *DKIMSigner
+
+	ResetURL    string
+	ResetExpire time.Duration
+
+	// the List-Unsubscribe link of notifications is UnsubscribeURL<token>
+	UnsubscribeURL    string
+	unsubscribeKey    []byte
+	unsubscribeMaxAge time.Duration
 }
 
-func newEmail(config *Config) (*Email, error) {
-	server := fmt.Sprintf("%s:%d", config.Email.Host, config.Email.Port)
+func newEmail(config *Config, db *gorm.DB) (*Email, error) {
+	mailer, err := newMailer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	templates, err := newEmailTemplates(config)
+	if err != nil {
+		return nil, err
+	}
 
-	tmpl, err := template.New("captcha.template").ParseFiles(config.Email.Template)
+	dkim, err := newDKIMSigner(config)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.Email.CaptchaKey == "" {
+		return nil, errors.New("email captcha key is required")
+	}
+	if config.Email.UnsubscribeKey == "" {
+		return nil, errors.New("email unsubscribe key is required")
+	}
+
+	fromName := config.Email.FromName
+	if fromName == "" {
+		fromName = defaultEmailFromName
+	}
+	unsubscribeMaxAge := time.Duration(config.Email.UnsubscribeMaxAge) * time.Second
+	if unsubscribeMaxAge <= 0 {
+		unsubscribeMaxAge = defaultEmailUnsubscribeMaxAge
+	}
+
 	return &Email{
-		Host:     config.Email.Host,
-		Port:     config.Email.Port,
-		From:     config.Email.From,
-		Password: config.Email.Password,
-		Server:   server,
-		Template: tmpl,
+		From:        config.Email.From,
+		FromName:    fromName,
+		Outbox:      newOutbox(config, db, mailer),
+		Templates:   templates,
+		DKIM:        dkim,
+		ResetURL:    config.Email.ResetURL,
+		ResetExpire: time.Duration(config.Email.ResetExpire) * time.Second,
+
+		UnsubscribeURL:    config.Email.UnsubscribeURL,
+		unsubscribeKey:    []byte(config.Email.UnsubscribeKey),
+		unsubscribeMaxAge: unsubscribeMaxAge,
 	}, nil
 }
 
-func (e *Email) dial() (*smtp.Client, error) {
-	conn, err := net.Dial("tcp", e.Server)
+func writeQuotedPrintable(mw *multipart.Writer, contentType string, body []byte) error {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := mw.CreatePart(h)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	w := quotedprintable.NewWriter(part)
+	if _, err := w.Write(body); err != nil {
+		return err
 	}
+	return w.Close()
+}
 
-	return smtp.NewClient(conn, e.Host)
+// messageID returns a unique Message-ID in the domain of From (RFC 5322 3.6.4)
+func (e *Email) messageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if i := strings.LastIndex(e.From, "@"); i >= 0 && i < len(e.From)-1 {
+		domain = e.From[i+1:]
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(b), domain), nil
 }
 
-func (e *Email) sendMailTLS(to []string, msg []byte) (err error) {
-	c, err := e.dial()
+// compose builds a multipart/alternative message, the text part first as the one least preferred
+func (e *Email) compose(to string, subject string, headers map[string]string, text []byte, html []byte) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := writeQuotedPrintable(mw, "text/plain; charset=UTF-8", text); err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(mw, "text/html; charset=UTF-8", html); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	messageID, err := e.messageID()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	from := mail.Address{Name: e.FromName, Address: e.From}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", messageID)
+	fmt.Fprintf(&msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", (&mail.Address{Address: to}).String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, headers[name])
 	}
-	defer func() {
-		_ = c.Close()
-	}()
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
 
-	if err = c.StartTLS(&tls.Config{
-		ServerName: e.Host,
-	}); err != nil {
+	if e.DKIM != nil {
+		return e.DKIM.Sign(msg.Bytes())
+	}
+	return msg.Bytes(), nil
+}
+
+// send renders kind in the locale closest to locale and queues the message, it is delivered by the outbox
+func (e *Email) send(kind string, locale string, to string, headers map[string]string, data map[string]interface{}) error {
+	subject, text, html, err := e.Templates.render(kind, locale, data)
+	if err != nil {
 		return err
 	}
 
-	err = smtp.SendMail(
-		e.Server,
-		smtp.PlainAuth("", e.From, e.Password, e.Host),
-		e.From,
-		to,
-		msg,
-	)
-	// https://www.google.com/settings/security/lesssecureapps
+	msg, err := e.compose(to, subject, headers, text, html)
 	if err != nil {
 		return err
 	}
 
-	return c.Quit()
+	_, err = e.Outbox.Enqueue(e.From, to, subject, msg)
+	return err
+}
+
+// Send mails a captcha, locale is a locale or an Accept-Language header
+func (e *Email) Send(captcha string, to string, expire time.Duration, locale string) error {
+	return e.send(EmailKindCaptcha, locale, to, nil, map[string]interface{}{
+		"Captcha": captcha,
+		"Minutes": int(expire.Minutes()),
+	})
+}
+
+// SendReset mails the password reset link carrying token
+func (e *Email) SendReset(token string, to string, locale string) error {
+	return e.send(EmailKindReset, locale, to, nil, map[string]interface{}{
+		"Link":    e.ResetURL + "?" + url.Values{"token": {token}}.Encode(),
+		"Minutes": int(e.ResetExpire.Minutes()),
+	})
 }
 
-func (e *Email) Send(captcha string, to string) error {
-	data := struct {
-		From    string
-		To      string
-		Subject string
-		Captcha string
-	}{
-		From:    e.From,
-		To:      to,
-		Subject: "Email Verification",
-		Captcha: captcha,
-	}
-
-	var buf bytes.Buffer
-	err := e.Template.Execute(&buf, data)
+func (e *Email) unsubscribeSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, e.unsubscribeKey)
+	mac.Write([]byte("unsubscribe:" + payload))
+	return mac.Sum(nil)
+}
+
+// UnsubscribeToken returns the token unsubscribing userID from notification, valid for [email] unsubscribeMaxAge
+func (e *Email) UnsubscribeToken(userID uint, notification models.Notification) string {
+	payload := fmt.Sprintf("%d:%s:%d", userID, notification, time.Now().Unix())
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(e.unsubscribeSignature(payload))
+}
+
+// ParseUnsubscribeToken returns the user and the notification of a token made by UnsubscribeToken
+func (e *Email) ParseUnsubscribeToken(token string) (uint, models.Notification, error) {
+	encoded, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, "", errors.New("malformed unsubscribe token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
 	if err != nil {
-		return err
+		return 0, "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return 0, "", err
+	}
+	if !hmac.Equal(signature, e.unsubscribeSignature(string(payload))) {
+		return 0, "", errors.New("invalid unsubscribe token signature")
 	}
 
-	err = e.sendMailTLS(
-		[]string{to},
-		buf.Bytes(),
-	)
+	fields := strings.Split(string(payload), ":")
+	if len(fields) != 3 {
+		return 0, "", errors.New("malformed unsubscribe token")
+	}
+	userID, err := strconv.ParseUint(fields[0], 10, 64)
 	if err != nil {
-		println(err.Error())
-		return err
+		return 0, "", err
+	}
+	issuedAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if time.Since(time.Unix(issuedAt, 0)) > e.unsubscribeMaxAge {
+		return 0, "", errors.New("expired unsubscribe token")
 	}
+	return uint(userID), models.Notification(fields[1]), nil
+}
+
+// SendNotification mails kind to the user, with List-Unsubscribe headers (RFC 2369, RFC 8058)
+// and an UnsubscribeURL in data, the caller checks that the user wants notification
+func (e *Email) SendNotification(
+	notification models.Notification, userID uint, kind string, locale string, to string, data map[string]interface{},
+) error {
+	link := e.UnsubscribeURL + e.UnsubscribeToken(userID, notification)
+	data["UnsubscribeURL"] = link
 
-	return nil
+	return e.send(kind, locale, to, map[string]string{
+		"List-Unsubscribe":      "<" + link + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}, data)
 }
@@ -0,0 +1,50 @@
+package runtime
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mylakehead/agile/models"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	e := &Email{unsubscribeKey: []byte("unsubscribe key"), unsubscribeMaxAge: time.Hour}
+
+	token := e.UnsubscribeToken(42, models.NotificationAnnouncements)
+	userID, notification, err := e.ParseUnsubscribeToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 42 || notification != models.NotificationAnnouncements {
+		t.Errorf("token of %d %s, want 42 announcements", userID, notification)
+	}
+
+	// tokens signed some time ago, the signature being valid
+	signed := func(payload string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+			base64.RawURLEncoding.EncodeToString(e.unsubscribeSignature(payload))
+	}
+	if _, _, err := e.ParseUnsubscribeToken(signed(fmt.Sprintf("42:announcements:%d",
+		time.Now().Add(-time.Hour+time.Minute).Unix()))); err != nil {
+		t.Errorf("token within the max age rejected: %v", err)
+	}
+
+	encoded, signature, _ := strings.Cut(token, ".")
+	other := &Email{unsubscribeKey: []byte("other key"), unsubscribeMaxAge: time.Hour}
+	for name, invalid := range map[string]string{
+		"expired":           signed(fmt.Sprintf("42:announcements:%d", time.Now().Add(-time.Hour-time.Minute).Unix())),
+		"without issued at": signed("42:announcements"),
+		"another user": base64.RawURLEncoding.EncodeToString(
+			[]byte(fmt.Sprintf("43:announcements:%d", time.Now().Unix()))) + "." + signature,
+		"another key":  other.UnsubscribeToken(42, models.NotificationAnnouncements),
+		"no signature": encoded,
+		"malformed":    "not a token",
+	} {
+		if _, _, err := e.ParseUnsubscribeToken(invalid); err == nil {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+}
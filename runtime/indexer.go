@@ -0,0 +1,461 @@
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+)
+
+/*
+the indexer follows the Purchased events of the market contract into the purchased table.
+
+only blocks with [chain] confirmations on top of them are indexed. after each range of blocks
+the last one is stored as a checkpoint, in the same transaction as its purchases, so that a restart
+continues where it stopped. before each range the latest checkpoint is compared with the chain:
+if its block was replaced by a reorg, the indexer goes back to the newest checkpoint still on the chain,
+deleting the purchases after it, and indexes again from there.
+*/
+
+const (
+	purchasedIndexer = "purchased"
+
+	defaultIndexerConfirmations = 12
+	defaultIndexerBatch         = 1000
+	defaultIndexerInterval      = 5 * time.Second
+	defaultAmountDecimals       = 2
+
+	// enough to find the fork of any reorg the confirmations do not already hide
+	indexerCheckpoints = 128
+)
+
+// marketABI is the Purchased event as the purchased table records it, used when [chain] marketAbi is not set.
+// the market contract is not part of this repository, so this is not generated from its source:
+// a contract emitting another signature has other topics and nothing is indexed. [chain] marketAbi takes
+// the ABI of the deployed contract instead, NewIndexer then refuses a Purchased event that does not match.
+const marketABI = `[{
+	"type": "event",
+	"name": "Purchased",
+	"anonymous": false,
+	"inputs": [
+		{"name": "blockId", "type": "uint256", "indexed": true},
+		{"name": "offerId", "type": "uint256", "indexed": true},
+		{"name": "seller", "type": "address", "indexed": false},
+		{"name": "buyer", "type": "address", "indexed": false},
+		{"name": "amount", "type": "uint256", "indexed": false}
+	]
+}]`
+
+// the inputs of Purchased, whichever of them are indexed
+var purchasedInputs = map[string]string{
+	"blockId": "uint256",
+	"offerId": "uint256",
+	"seller":  "address",
+	"buyer":   "address",
+	"amount":  "uint256",
+}
+
+func errMarketPurchased(event abi.Event) error {
+	return fmt.Errorf("market abi: %s, want uint256 blockId, uint256 offerId, address seller, "+
+		"address buyer and uint256 amount", event.Sig)
+}
+
+type purchasedEvent struct {
+	BlockId *big.Int
+	OfferId *big.Int
+	Seller  common.Address
+	Buyer   common.Address
+	Amount  *big.Int
+}
+
+type IndexerConfig struct {
+	// the market contract
+	Market common.Address
+	// the ABI of the market as JSON, marketABI if empty
+	ABI string
+	// the block the market was deployed in, nothing before it is read
+	StartBlock    uint64
+	Confirmations uint64
+	// blocks read with one eth_getLogs
+	Batch    uint64
+	Interval time.Duration
+	// of the amount of the event, the purchased table keeps 2
+	AmountDecimals int
+}
+
+type Indexer struct {
+	db     *gorm.DB
+	cli    ChainClient
+	config IndexerConfig
+	abi    abi.ABI
+	event  abi.Event
+	// the inputs of event found in the topics
+	indexed abi.Arguments
+
+	// cancels the poll in progress when Close runs out of time
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewIndexer indexes the purchases of config.Market on cli into db, it is started by Start
+// or driven by calling Poll, e.g. against the simulated backend
+func NewIndexer(db *gorm.DB, cli ChainClient, config IndexerConfig) (*Indexer, error) {
+	if config.ABI == "" {
+		config.ABI = marketABI
+	}
+	parsed, err := abi.JSON(strings.NewReader(config.ABI))
+	if err != nil {
+		return nil, fmt.Errorf("market abi: %w", err)
+	}
+	event, ok := parsed.Events["Purchased"]
+	if !ok {
+		return nil, errors.New("market abi: no Purchased event")
+	}
+	if len(event.Inputs) != len(purchasedInputs) {
+		return nil, errMarketPurchased(event)
+	}
+	for _, input := range event.Inputs {
+		if purchasedInputs[input.Name] != input.Type.String() {
+			return nil, errMarketPurchased(event)
+		}
+	}
+
+	if config.Confirmations == 0 {
+		config.Confirmations = defaultIndexerConfirmations
+	}
+	if config.Batch == 0 {
+		config.Batch = defaultIndexerBatch
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultIndexerInterval
+	}
+
+	var indexed abi.Arguments
+	for _, input := range event.Inputs {
+		if input.Indexed {
+			indexed = append(indexed, input)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Indexer{
+		db:      db,
+		cli:     cli,
+		config:  config,
+		abi:     parsed,
+		event:   event,
+		indexed: indexed,
+		ctx:     ctx,
+		cancel:  cancel,
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// newIndexer indexes the market of [chain], there is no indexer without a chain or a market
+func newIndexer(config *Config, db *gorm.DB, chain *Chain) (*Indexer, error) {
+	c := config.Chain
+	if chain == nil || c.Market == "" {
+		return nil, nil
+	}
+	if !common.IsHexAddress(c.Market) {
+		return nil, fmt.Errorf("invalid market address: %s", c.Market)
+	}
+
+	decimals := defaultAmountDecimals
+	if c.AmountDecimals != nil {
+		decimals = *c.AmountDecimals
+	}
+
+	marketABI := ""
+	if c.MarketABI != "" {
+		content, err := os.ReadFile(c.MarketABI)
+		if err != nil {
+			return nil, err
+		}
+		// build artifacts keep the ABI in a field
+		artifact := struct {
+			ABI json.RawMessage `json:"abi"`
+		}{}
+		if json.Unmarshal(content, &artifact) == nil && len(artifact.ABI) > 0 {
+			content = artifact.ABI
+		}
+		marketABI = string(content)
+	}
+
+	return NewIndexer(db, chain.Cli, IndexerConfig{
+		Market:         common.HexToAddress(c.Market),
+		ABI:            marketABI,
+		StartBlock:     c.StartBlock,
+		Confirmations:  c.Confirmations,
+		Batch:          c.Batch,
+		Interval:       time.Duration(c.Interval) * time.Second,
+		AmountDecimals: decimals,
+	})
+}
+
+// Start polls in the background until Close
+func (ix *Indexer) Start() {
+	ix.wg.Add(1)
+	go func() {
+		defer ix.wg.Done()
+
+		for {
+			caughtUp, err := ix.Poll(ix.ctx)
+			if err != nil && ix.ctx.Err() == nil {
+				log.Printf("[indexer] %v", err)
+			}
+			// catching up goes on right away
+			if err == nil && !caughtUp {
+				select {
+				case <-ix.stop:
+					return
+				default:
+					continue
+				}
+			}
+
+			select {
+			case <-ix.stop:
+				return
+			case <-time.After(ix.config.Interval):
+			}
+		}
+	}()
+}
+
+// Close stops polling and waits for the range being indexed, which is given up if ctx is done first.
+// a range is committed with its checkpoint or not at all, so it is indexed again on the next start
+func (ix *Indexer) Close(ctx context.Context) error {
+	close(ix.stop)
+
+	finished := make(chan struct{})
+	go func() {
+		ix.wg.Wait()
+		close(finished)
+	}()
+	defer ix.cancel()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		ix.cancel()
+		<-finished
+		return ctx.Err()
+	}
+}
+
+func (ix *Indexer) latestCheckpoint(ctx context.Context) (*models.ChainCheckpoint, error) {
+	var checkpoint models.ChainCheckpoint
+	err := ix.db.WithContext(ctx).Where("indexer = ?", purchasedIndexer).Order("number DESC").First(&checkpoint).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// Poll indexes the next range of confirmed blocks, it tells whether the indexer has caught up
+func (ix *Indexer) Poll(ctx context.Context) (bool, error) {
+	head, err := ix.cli.BlockNumber(ctx)
+	if err != nil {
+		return false, err
+	}
+	if head < ix.config.Confirmations {
+		return true, nil
+	}
+	confirmed := head - ix.config.Confirmations
+
+	from := ix.config.StartBlock
+	checkpoint, err := ix.latestCheckpoint(ctx)
+	if err != nil {
+		return false, err
+	}
+	if checkpoint != nil {
+		header, err := ix.cli.HeaderByNumber(ctx, new(big.Int).SetUint64(checkpoint.Number))
+		if err != nil {
+			return false, err
+		}
+		if header.Hash().Hex() != checkpoint.Hash {
+			return false, ix.rewind(ctx)
+		}
+		from = checkpoint.Number + 1
+	}
+	if from > confirmed {
+		return true, nil
+	}
+
+	to := from + ix.config.Batch - 1
+	if to > confirmed {
+		to = confirmed
+	}
+	if err := ix.index(ctx, from, to); err != nil {
+		return false, err
+	}
+
+	return to == confirmed, nil
+}
+
+// index stores the purchases of the blocks from to to, and to as the checkpoint
+func (ix *Indexer) index(ctx context.Context, from uint64, to uint64) error {
+	last, err := ix.cli.HeaderByNumber(ctx, new(big.Int).SetUint64(to))
+	if err != nil {
+		return err
+	}
+
+	logs, err := ix.cli.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: []common.Address{ix.config.Market},
+		Topics:    [][]common.Hash{{ix.event.ID}},
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := map[uint64]*types.Header{to: last}
+	purchases := make([]models.Purchased, 0, len(logs))
+	for i := range logs {
+		l := &logs[i]
+		if l.Removed {
+			continue
+		}
+
+		header, ok := headers[l.BlockNumber]
+		if !ok {
+			header, err = ix.cli.HeaderByNumber(ctx, new(big.Int).SetUint64(l.BlockNumber))
+			if err != nil {
+				return err
+			}
+			headers[l.BlockNumber] = header
+		}
+		// a reorg between the calls, the next poll starts over
+		if header.Hash() != l.BlockHash {
+			return fmt.Errorf("block %d changed while indexing", l.BlockNumber)
+		}
+
+		purchase, err := ix.parse(l, header)
+		if err != nil {
+			return fmt.Errorf("purchase in %s log %d: %w", l.TxHash.Hex(), l.Index, err)
+		}
+		purchases = append(purchases, *purchase)
+	}
+
+	return ix.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(purchases) > 0 {
+			// seller and buyer stay as they are, they are anonymized for deleted accounts
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "block_id"}},
+				DoUpdates: clause.AssignmentColumns([]string{
+					"updated_at", "offer_id", "amount", "timestamp", "chain_block", "tx_hash", "log_index",
+				}),
+			}).Create(&purchases).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Create(&models.ChainCheckpoint{
+			Indexer: purchasedIndexer,
+			Number:  to,
+			Hash:    last.Hash().Hex(),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		// keep the latest checkpoints only
+		var oldest []models.ChainCheckpoint
+		err = tx.Where("indexer = ?", purchasedIndexer).Order("number DESC").
+			Offset(indexerCheckpoints - 1).Limit(1).Find(&oldest).Error
+		if err != nil || len(oldest) == 0 {
+			return err
+		}
+		return tx.Where("indexer = ? AND number < ?", purchasedIndexer, oldest[0].Number).
+			Delete(&models.ChainCheckpoint{}).Error
+	})
+}
+
+func (ix *Indexer) parse(l *types.Log, header *types.Header) (*models.Purchased, error) {
+	var event purchasedEvent
+	if err := ix.abi.UnpackIntoInterface(&event, ix.event.Name, l.Data); err != nil {
+		return nil, err
+	}
+	if err := abi.ParseTopics(&event, ix.indexed, l.Topics[1:]); err != nil {
+		return nil, err
+	}
+	if !event.BlockId.IsUint64() || !event.OfferId.IsUint64() {
+		return nil, errors.New("id out of range")
+	}
+
+	amount, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(event.Amount),
+		new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(ix.config.AmountDecimals)), nil)),
+	).Float64()
+
+	return &models.Purchased{
+		BlockID:    event.BlockId.Uint64(),
+		OfferID:    event.OfferId.Uint64(),
+		Seller:     lib.NormalizeAddress(event.Seller.Hex()),
+		Buyer:      lib.NormalizeAddress(event.Buyer.Hex()),
+		Amount:     amount,
+		Timestamp:  header.Time,
+		ChainBlock: l.BlockNumber,
+		TxHash:     l.TxHash.Hex(),
+		LogIndex:   l.Index,
+	}, nil
+}
+
+// rewind goes back to the newest checkpoint still on the chain and deletes what was indexed after it
+func (ix *Indexer) rewind(ctx context.Context) error {
+	var checkpoints []models.ChainCheckpoint
+	err := ix.db.WithContext(ctx).Where("indexer = ?", purchasedIndexer).Order("number DESC").Find(&checkpoints).Error
+	if err != nil {
+		return err
+	}
+
+	for _, checkpoint := range checkpoints {
+		header, err := ix.cli.HeaderByNumber(ctx, new(big.Int).SetUint64(checkpoint.Number))
+		if err != nil {
+			return err
+		}
+		if header.Hash().Hex() != checkpoint.Hash {
+			continue
+		}
+
+		log.Printf("[indexer] reorg, going back to block %d", checkpoint.Number)
+		return ix.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			err := tx.Where("chain_block > ?", checkpoint.Number).Delete(&models.Purchased{}).Error
+			if err != nil {
+				return err
+			}
+			return tx.Where("indexer = ? AND number > ?", purchasedIndexer, checkpoint.Number).
+				Delete(&models.ChainCheckpoint{}).Error
+		})
+	}
+
+	// deeper than every checkpoint, the purchases are kept and updated as the blocks are indexed again
+	log.Printf("[indexer] reorg deeper than block %d, indexing again from block %d",
+		checkpoints[len(checkpoints)-1].Number, ix.config.StartBlock)
+	return ix.db.WithContext(ctx).Where("indexer = ?", purchasedIndexer).Delete(&models.ChainCheckpoint{}).Error
+}
@@ -0,0 +1,324 @@
+package runtime
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/mylakehead/agile/lib"
+	"github.com/mylakehead/agile/models"
+)
+
+// market emits Purchased(blockId, offerId, seller, buyer, amount) with the five words of its calldata
+func market(t *testing.T) []byte {
+	t.Helper()
+
+	parsed, err := NewIndexer(nil, nil, IndexerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var code []byte
+	code = append(code, 0x60, 0x60, 0x60, 0x40, 0x60, 0x00, 0x37) // CALLDATACOPY(0, 64, 96), seller buyer amount
+	code = append(code, 0x60, 0x20, 0x35, 0x60, 0x00, 0x35)       // CALLDATALOAD(32) offerId, CALLDATALOAD(0) blockId
+	code = append(code, 0x7f)                                     // PUSH32 the event topic
+	code = append(code, parsed.event.ID.Bytes()...)
+	code = append(code, 0x60, 0x60, 0x60, 0x00, 0xa3, 0x00) // LOG3(0, 96, topic, blockId, offerId), STOP
+	return code
+}
+
+type testChain struct {
+	t       *testing.T
+	backend *simulated.Backend
+	cli     simulated.Client
+	keys    []*ecdsa.PrivateKey
+}
+
+func newTestChain(t *testing.T) *testChain {
+	c := &testChain{t: t}
+	alloc := types.GenesisAlloc{}
+	for _, seed := range []string{"seller", "buyer"} {
+		key, err := crypto.ToECDSA(crypto.Keccak256([]byte(seed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.keys = append(c.keys, key)
+		alloc[crypto.PubkeyToAddress(key.PublicKey)] = types.Account{Balance: big.NewInt(params.Ether)}
+	}
+
+	c.backend = simulated.NewBackend(alloc)
+	t.Cleanup(func() {
+		_ = c.backend.Close()
+	})
+	c.cli = c.backend.Client()
+	return c
+}
+
+// send signs a transaction of key, a contract creation if to is nil, and commits it in a block
+func (c *testChain) send(key *ecdsa.PrivateKey, to *common.Address, data []byte) uint64 {
+	c.t.Helper()
+
+	nonce, err := c.cli.PendingNonceAt(context.Background(), crypto.PubkeyToAddress(key.PublicKey))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.sendAt(key, nonce, 10*params.GWei, to, data); err != nil {
+		c.t.Fatal(err)
+	}
+	return nonce
+}
+
+// sendAt is send with the nonce and the gas price given, to replace a transaction
+func (c *testChain) sendAt(key *ecdsa.PrivateKey, nonce uint64, gasPrice int64, to *common.Address, data []byte) error {
+	tx := types.NewTx(&types.LegacyTx{
+		Nonce: nonce, To: to, Gas: 1_000_000, GasPrice: big.NewInt(gasPrice), Data: data,
+	})
+	signed, err := types.SignTx(tx, types.LatestSignerForChainID(params.AllDevChainProtocolChanges.ChainID), key)
+	if err != nil {
+		return err
+	}
+	if err := c.cli.SendTransaction(context.Background(), signed); err != nil {
+		return err
+	}
+	c.backend.Commit()
+	return nil
+}
+
+func (c *testChain) deploy(code []byte) common.Address {
+	c.t.Helper()
+
+	// copies the runtime code behind these 11 bytes into memory and returns it
+	init := append([]byte{0x60, byte(len(code)), 0x80, 0x60, 0x0b, 0x60, 0x00, 0x39, 0x60, 0x00, 0xf3}, code...)
+	nonce := c.send(c.keys[0], nil, init)
+	return crypto.CreateAddress(crypto.PubkeyToAddress(c.keys[0].PublicKey), nonce)
+}
+
+// purchase is the calldata of market emitting a purchase of blockID sold by the first key to the second one
+func (c *testChain) purchase(blockID uint64, amount int64) []byte {
+	var data []byte
+	for _, word := range [][]byte{
+		new(big.Int).SetUint64(blockID).Bytes(),
+		new(big.Int).SetUint64(blockID * 10).Bytes(),
+		crypto.PubkeyToAddress(c.keys[0].PublicKey).Bytes(),
+		crypto.PubkeyToAddress(c.keys[1].PublicKey).Bytes(),
+		big.NewInt(amount).Bytes(),
+	} {
+		data = append(data, common.LeftPadBytes(word, 32)...)
+	}
+	return data
+}
+
+func (c *testChain) hash(number uint64) string {
+	c.t.Helper()
+
+	header, err := c.cli.HeaderByNumber(context.Background(), new(big.Int).SetUint64(number))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return header.Hash().Hex()
+}
+
+// newTestDB opens an empty SQLite database with tables migrated
+func newTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "indexer.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// catchUp polls until the indexer has caught up
+func catchUp(t *testing.T, ix *Indexer) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		caughtUp, err := ix.Poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caughtUp {
+			return
+		}
+	}
+	t.Fatal("indexer does not catch up")
+}
+
+// assertIndexed checks the purchased rows by block id, and that every checkpoint is on the chain
+func assertIndexed(t *testing.T, db *gorm.DB, chain *testChain, want map[uint64]uint64, latest uint64) {
+	t.Helper()
+
+	var purchases []models.Purchased
+	if err := db.Order("block_id").Find(&purchases).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[uint64]uint64)
+	for _, p := range purchases {
+		got[p.BlockID] = p.ChainBlock
+		if p.OfferID != p.BlockID*10 || p.Amount != 12.34 ||
+			p.Seller != lib.NormalizeAddress(crypto.PubkeyToAddress(chain.keys[0].PublicKey).Hex()) ||
+			p.Buyer != lib.NormalizeAddress(crypto.PubkeyToAddress(chain.keys[1].PublicKey).Hex()) {
+			t.Errorf("unexpected purchase %+v", p)
+		}
+		if p.TxHash == "" || p.Timestamp == 0 {
+			t.Errorf("purchase %d without transaction or time", p.BlockID)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("purchases in blocks %v, want %v", got, want)
+	}
+	for id, block := range want {
+		if got[id] != block {
+			t.Fatalf("purchases in blocks %v, want %v", got, want)
+		}
+	}
+
+	var checkpoints []models.ChainCheckpoint
+	if err := db.Order("number").Find(&checkpoints).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints) == 0 || checkpoints[len(checkpoints)-1].Number != latest {
+		t.Fatalf("checkpoints %+v, want the latest at %d", checkpoints, latest)
+	}
+	for _, checkpoint := range checkpoints {
+		if checkpoint.Hash != chain.hash(checkpoint.Number) {
+			t.Errorf("checkpoint %d is not on the chain", checkpoint.Number)
+		}
+	}
+}
+
+func TestIndexerReorg(t *testing.T) {
+	chain := newTestChain(t)
+	db := newTestDB(t, &models.Purchased{}, &models.ChainCheckpoint{})
+
+	address := chain.deploy(market(t)) // block 1
+	ix, err := NewIndexer(db, chain.cli, IndexerConfig{
+		Market:         address,
+		Confirmations:  2,
+		Batch:          2,
+		AmountDecimals: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain.send(chain.keys[0], &address, chain.purchase(1, 1234)) // block 2
+	chain.send(chain.keys[0], &address, chain.purchase(2, 1234)) // block 3
+	chain.backend.Commit()
+	chain.backend.Commit()
+	catchUp(t, ix)
+	assertIndexed(t, db, chain, map[uint64]uint64{1: 2, 2: 3}, 3)
+
+	// not confirmed yet
+	replaced := chain.send(chain.keys[0], &address, chain.purchase(3, 1234)) // block 6
+	catchUp(t, ix)
+	assertIndexed(t, db, chain, map[uint64]uint64{1: 2, 2: 3}, 4)
+
+	chain.backend.Commit()
+	chain.backend.Commit()
+	catchUp(t, ix)
+	assertIndexed(t, db, chain, map[uint64]uint64{1: 2, 2: 3, 3: 6}, 6)
+
+	// block 6 is replaced by one with another purchase
+	if err := chain.backend.Fork(common.HexToHash(chain.hash(5))); err != nil {
+		t.Fatal(err)
+	}
+	// the pool puts the transactions of dropped blocks back once it has caught up with the fork,
+	// so the transaction of purchase 3 is replaced, else it would be included again
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := chain.sendAt(chain.keys[0], replaced, 20*params.GWei, &address, chain.purchase(4, 1234)) // block 6'
+		if err == nil {
+			break
+		}
+		if !strings.Contains(err.Error(), "nonce too low") || time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		chain.backend.Commit()
+	}
+	head, err := chain.cli.BlockNumber(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != 10 {
+		t.Fatalf("head %d after the reorg, want 10", head)
+	}
+
+	catchUp(t, ix)
+	assertIndexed(t, db, chain, map[uint64]uint64{1: 2, 2: 3, 4: 6}, 8)
+}
+
+func TestIndexerRestart(t *testing.T) {
+	chain := newTestChain(t)
+	db := newTestDB(t, &models.Purchased{}, &models.ChainCheckpoint{})
+
+	address := chain.deploy(market(t))
+	config := IndexerConfig{Market: address, Confirmations: 1, Interval: 10 * time.Millisecond, AmountDecimals: 2}
+	chain.send(chain.keys[0], &address, chain.purchase(1, 1234))
+	chain.backend.Commit()
+
+	ix, err := NewIndexer(db, chain.cli, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var count int64
+		if err := db.Model(&models.Purchased{}).Count(&count).Error; err != nil {
+			t.Fatal(err)
+		}
+		if count == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("purchase not indexed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ix.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new indexer continues after the checkpoint of the previous one
+	chain.send(chain.keys[0], &address, chain.purchase(2, 1234))
+	chain.backend.Commit()
+	ix, err = NewIndexer(db, chain.cli, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catchUp(t, ix)
+	assertIndexed(t, db, chain, map[uint64]uint64{1: 2, 2: 4}, 4)
+
+	var numbers []uint64
+	if err := db.Model(&models.ChainCheckpoint{}).Pluck("number", &numbers).Error; err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	if numbers[0] != 2 {
+		t.Errorf("checkpoints %v, the second indexer started over", numbers)
+	}
+}
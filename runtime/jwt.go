@@ -0,0 +1,241 @@
+package runtime
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"github.com/mylakehead/agile/lib"
+)
+
+/*
+tokens are signed with the key pair named by [jwt] signingKey and carry its id in the kid header.
+every configured key verifies tokens, so a new key is added first, then made the signing key,
+and the old one is removed once the tokens it signed have expired.
+the public keys are published at /.well-known/jwks.json.
+
+without key pairs, tokens are signed with the HS256 shared secret [jwt] key as before.
+to move to key pairs, [jwt] keyAcceptedUntil bounds how long tokens signed with the secret are still accepted,
+it is required when both the secret and a signing key are configured.
+*/
+
+type JWTKeyConfig struct {
+	ID        string
+	Algorithm string
+	// PEM, either a private key or, for keys which only verify, a public key
+	File string
+}
+
+type JWTKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+type JWTKeys struct {
+	signing *JWTKey
+	keys    map[string]*JWTKey
+	// HS256 shared secret, nil if disabled
+	secret []byte
+	// zero while the secret signs tokens, else when tokens signed with it stop being accepted
+	secretUntil time.Time
+}
+
+func newJWTKeys(config *Config) (*JWTKeys, error) {
+	k := &JWTKeys{
+		keys: make(map[string]*JWTKey),
+	}
+	if config.Jwt.Key != "" {
+		k.secret = []byte(config.Jwt.Key)
+	}
+
+	for _, c := range config.Jwt.Keys {
+		key, err := loadJWTKey(&c)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: %w", c.ID, err)
+		}
+		k.keys[key.ID] = key
+	}
+
+	if config.Jwt.SigningKey != "" {
+		key, ok := k.keys[config.Jwt.SigningKey]
+		if !ok || key.Private == nil {
+			return nil, fmt.Errorf("jwt signing key %s has no private key", config.Jwt.SigningKey)
+		}
+		k.signing = key
+		if k.secret != nil {
+			if config.Jwt.KeyAcceptedUntil.IsZero() {
+				return nil, errors.New("jwt key next to a signing key requires jwt keyAcceptedUntil")
+			}
+			k.secretUntil = config.Jwt.KeyAcceptedUntil
+		}
+	} else if k.secret == nil {
+		return nil, errors.New("neither jwt signing key nor jwt key configured")
+	}
+
+	return k, nil
+}
+
+func loadJWTKey(c *JWTKeyConfig) (*JWTKey, error) {
+	if c.ID == "" {
+		return nil, errors.New("id is required")
+	}
+	method := jwt.GetSigningMethod(c.Algorithm)
+	if method == nil {
+		return nil, fmt.Errorf("unknown algorithm %s", c.Algorithm)
+	}
+
+	content, err := os.ReadFile(c.File)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+
+	key := &JWTKey{ID: c.ID, Method: method}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key.Public, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key.Private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key.Private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			signer, ok := parsed.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("unsupported private key")
+			}
+			key.Private = signer
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key.Private != nil {
+		key.Public = key.Private.Public()
+	}
+
+	if err := matchJWTKeyMethod(key.Public, method); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// matchJWTKeyMethod checks that the algorithm fits the key, otherwise tokens could not be verified
+func matchJWTKeyMethod(public crypto.PublicKey, method jwt.SigningMethod) error {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if _, ok := method.(*jwt.SigningMethodRSA); !ok {
+			return fmt.Errorf("%s is not an RSA algorithm", method.Alg())
+		}
+	case *ecdsa.PublicKey:
+		m, ok := method.(*jwt.SigningMethodECDSA)
+		if !ok || m.CurveBits != public.Curve.Params().BitSize {
+			return fmt.Errorf("%s does not match the EC key", method.Alg())
+		}
+	case ed25519.PublicKey:
+		if method != lib.EdDSA {
+			return fmt.Errorf("%s is not EdDSA", method.Alg())
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+
+	return nil
+}
+
+// Sign signs claims with the signing key, or the shared secret if there is none
+func (k *JWTKeys) Sign(claims jwt.Claims) (string, error) {
+	if k.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+
+	token := jwt.NewWithClaims(k.signing.Method, claims)
+	token.Header["kid"] = k.signing.ID
+	return token.SignedString(k.signing.Private)
+}
+
+// Keyfunc picks the key a token is verified with, by its kid header
+func (k *JWTKeys) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if k.secret == nil || (!k.secretUntil.IsZero() && !time.Now().Before(k.secretUntil)) {
+			return nil, errors.New("token without kid")
+		}
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("unexpected signing method")
+		}
+		return k.secret, nil
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %s", kid)
+	}
+	// never let the token choose the algorithm
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.Public, nil
+}
+
+// JWKS returns the public keys as a JSON Web Key Set (RFC 7517)
+func (k *JWTKeys) JWKS() map[string]interface{} {
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	keys := make([]map[string]string, 0)
+	for _, id := range ids {
+		key := k.keys[id]
+		jwk := map[string]string{
+			"kid": key.ID,
+			"alg": key.Method.Alg(),
+			"use": "sig",
+		}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk["kty"] = "EC"
+			jwk["crv"] = public.Curve.Params().Name
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+			jwk["y"] = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		}
+		keys = append(keys, jwk)
+	}
+
+	return map[string]interface{}{
+		"keys": keys,
+	}
+}
@@ -0,0 +1,328 @@
+package runtime
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/mylakehead/agile/lib"
+)
+
+// writeJWTKey writes key as PEM, the public key only if public is set, and returns its config
+func writeJWTKey(t *testing.T, id string, algorithm string, key crypto.Signer, public bool) JWTKeyConfig {
+	t.Helper()
+
+	var block *pem.Block
+	if public {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+
+	file := filepath.Join(t.TempDir(), id+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return JWTKeyConfig{ID: id, Algorithm: algorithm, File: file}
+}
+
+type jwtTestKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	// verifies only
+	old *ecdsa.PrivateKey
+	// the rsa, ec, ed25519 and old keys in this order
+	configs []JWTKeyConfig
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	k := &jwtTestKeys{}
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, k.ed25519, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.old, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	k.configs = []JWTKeyConfig{
+		writeJWTKey(t, "rsa", "RS256", k.rsa, false),
+		writeJWTKey(t, "ec", "ES256", k.ec, false),
+		writeJWTKey(t, "ed25519", "EdDSA", k.ed25519, false),
+		writeJWTKey(t, "old", "ES384", k.old, true),
+	}
+	return k
+}
+
+func newTestJWTKeys(t *testing.T, jwtConfig JWT) *JWTKeys {
+	t.Helper()
+
+	config := &Config{Jwt: jwtConfig}
+	keys, err := newJWTKeys(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func testClaims() jwt.StandardClaims {
+	return jwt.StandardClaims{Subject: "1", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+}
+
+func TestJWTKeysSign(t *testing.T) {
+	k := newJWTTestKeys(t)
+
+	for _, signing := range []string{"rsa", "ec", "ed25519"} {
+		t.Run(signing, func(t *testing.T) {
+			keys := newTestJWTKeys(t, JWT{SigningKey: signing, Keys: k.configs})
+
+			signed, err := keys.Sign(testClaims())
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := jwt.Parse(signed, keys.Keyfunc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Header["kid"] != signing || token.Method.Alg() != keys.keys[signing].Method.Alg() {
+				t.Errorf("signed with %v %s, want %s", token.Header["kid"], token.Method.Alg(), signing)
+			}
+		})
+	}
+
+	// tokens of a key which only verifies are accepted after a rotation
+	keys := newTestJWTKeys(t, JWT{SigningKey: "ec", Keys: k.configs})
+	old := jwt.NewWithClaims(jwt.SigningMethodES384, testClaims())
+	old.Header["kid"] = "old"
+	signed, err := old.SignedString(k.old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(signed, keys.Keyfunc); err != nil {
+		t.Errorf("token of the old key rejected: %v", err)
+	}
+}
+
+func TestJWTKeysKeyfunc(t *testing.T) {
+	k := newJWTTestKeys(t)
+	keys := newTestJWTKeys(t, JWT{SigningKey: "rsa", Keys: k.configs})
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, testClaims())
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	publicPEM, err := os.ReadFile(writeJWTKey(t, "public", "RS256", k.rsa, true).File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, signed := range map[string]string{
+		// the public key used as HMAC secret, the classic algorithm confusion
+		"HS256 with the rsa public key": sign(jwt.SigningMethodHS256, "rsa", publicPEM),
+		"RS512 of the rsa key":          sign(jwt.SigningMethodRS512, "rsa", k.rsa),
+		"RS256 under the ec kid":        sign(jwt.SigningMethodRS256, "ec", k.rsa),
+		"ES256 under the ed25519 kid":   sign(jwt.SigningMethodES256, "ed25519", k.ec),
+		"unknown kid":                   sign(jwt.SigningMethodES256, "other", k.ec),
+		"no kid":                        sign(jwt.SigningMethodES256, "", k.ec),
+		"none":                          sign(jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType),
+		"HS256 without a secret":        sign(jwt.SigningMethodHS256, "", []byte("agile.lakehead")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := jwt.Parse(signed, keys.Keyfunc); err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+}
+
+func TestJWTKeysSecret(t *testing.T) {
+	k := newJWTTestKeys(t)
+	secret := "agile.lakehead"
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims()).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without key pairs the secret signs and verifies
+	keys := newTestJWTKeys(t, JWT{Key: secret})
+	signed, err := keys.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{signed, legacy} {
+		if _, err := jwt.Parse(token, keys.Keyfunc); err != nil {
+			t.Errorf("HS256 token rejected: %v", err)
+		}
+	}
+
+	// next to a signing key only until keyAcceptedUntil
+	_, err = newJWTKeys(&Config{Jwt: JWT{Key: secret, SigningKey: "ec", Keys: k.configs}})
+	if err == nil || !strings.Contains(err.Error(), "keyAcceptedUntil") {
+		t.Errorf("secret next to a signing key without keyAcceptedUntil: %v", err)
+	}
+	keys = newTestJWTKeys(t, JWT{
+		Key: secret, KeyAcceptedUntil: time.Now().Add(time.Hour), SigningKey: "ec", Keys: k.configs,
+	})
+	if _, err := jwt.Parse(legacy, keys.Keyfunc); err != nil {
+		t.Errorf("HS256 token rejected during the migration: %v", err)
+	}
+	signed, err = keys.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _ := jwt.Parse(signed, keys.Keyfunc); token == nil || token.Method.Alg() != "ES256" {
+		t.Errorf("not signed with the signing key during the migration")
+	}
+
+	keys = newTestJWTKeys(t, JWT{
+		Key: secret, KeyAcceptedUntil: time.Now().Add(-time.Second), SigningKey: "ec", Keys: k.configs,
+	})
+	if _, err := jwt.Parse(legacy, keys.Keyfunc); err == nil {
+		t.Error("HS256 token accepted after keyAcceptedUntil")
+	}
+
+	// the way config.toml writes it
+	var config JWT
+	if err := toml.Unmarshal([]byte(`keyAcceptedUntil = 2026-10-02T00:00:00Z`), &config); err != nil {
+		t.Fatal(err)
+	}
+	if !config.KeyAcceptedUntil.Equal(time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("keyAcceptedUntil = %v", config.KeyAcceptedUntil)
+	}
+}
+
+func TestLoadJWTKeyAlgorithm(t *testing.T) {
+	k := newJWTTestKeys(t)
+
+	for name, c := range map[string]JWTKeyConfig{
+		"ES256 with an rsa key":   writeJWTKey(t, "a", "ES256", k.rsa, false),
+		"ES384 with a P-256 key":  writeJWTKey(t, "b", "ES384", k.ec, false),
+		"RS256 with an ed25519":   writeJWTKey(t, "c", "RS256", k.ed25519, false),
+		"EdDSA with an ec key":    writeJWTKey(t, "d", "EdDSA", k.ec, true),
+		"HS256 with an ec key":    writeJWTKey(t, "e", "HS256", k.ec, false),
+		"unknown algorithm":       writeJWTKey(t, "f", "ES999", k.ec, false),
+		"no id":                   writeJWTKey(t, "", "ES256", k.ec, false),
+		"signing without private": k.configs[3],
+		"missing file":            {ID: "g", Algorithm: "ES256", File: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := &Config{Jwt: JWT{SigningKey: c.ID, Keys: []JWTKeyConfig{c}}}
+			if _, err := newJWTKeys(config); err == nil {
+				t.Error("key accepted")
+			}
+		})
+	}
+}
+
+// jwkPublicKey decodes a JWK the way a verifying service does
+func jwkPublicKey(t *testing.T, jwk map[string]string) crypto.PublicKey {
+	t.Helper()
+
+	decode := func(name string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(jwk[name])
+		if err != nil || len(b) == 0 {
+			t.Fatalf("%s of %s: %q", name, jwk["kid"], jwk[name])
+		}
+		return b
+	}
+	switch jwk["kty"] {
+	case "RSA":
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(decode("n")), E: int(new(big.Int).SetBytes(decode("e")).Int64())}
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}
+		curve, ok := curves[jwk["crv"]]
+		x, y := decode("x"), decode("y")
+		if !ok || len(x) != (curve.Params().BitSize+7)/8 || len(y) != len(x) {
+			t.Fatalf("ec key %s: %v", jwk["kid"], jwk)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "OKP":
+		if jwk["crv"] != "Ed25519" {
+			t.Fatalf("okp key %s: %v", jwk["kid"], jwk)
+		}
+		return ed25519.PublicKey(decode("x"))
+	}
+	t.Fatalf("unknown kty of %v", jwk)
+	return nil
+}
+
+func TestJWTKeysJWKS(t *testing.T) {
+	k := newJWTTestKeys(t)
+	keys := newTestJWTKeys(t, JWT{SigningKey: "rsa", Keys: k.configs})
+
+	jwks := keys.JWKS()["keys"].([]map[string]string)
+	want := []struct {
+		kid    string
+		alg    string
+		public crypto.PublicKey
+	}{
+		{"ec", "ES256", k.ec.Public()},
+		{"ed25519", "EdDSA", k.ed25519.Public()},
+		{"old", "ES384", k.old.Public()},
+		{"rsa", "RS256", k.rsa.Public()},
+	}
+	if len(jwks) != len(want) {
+		t.Fatalf("%d keys, want %d", len(jwks), len(want))
+	}
+	for i, w := range want {
+		jwk := jwks[i]
+		if jwk["kid"] != w.kid || jwk["alg"] != w.alg || jwk["use"] != "sig" {
+			t.Errorf("key %d: %v, want %s %s", i, jwk, w.kid, w.alg)
+		}
+		if _, ok := jwk["d"]; ok {
+			t.Errorf("private key of %s published", w.kid)
+		}
+		public := jwkPublicKey(t, jwk).(interface{ Equal(crypto.PublicKey) bool })
+		if !public.Equal(w.public) {
+			t.Errorf("key %s does not decode to its public key", w.kid)
+		}
+	}
+
+	// a token signed with the EdDSA key verifies with the published key alone
+	signed, err := newTestJWTKeys(t, JWT{SigningKey: "ed25519", Keys: k.configs}).Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		return jwkPublicKey(t, jwks[1]), nil
+	})
+	if err != nil || lib.EdDSA.Alg() != jwks[1]["alg"] {
+		t.Errorf("EdDSA token does not verify with the JWK: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package runtime
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	emailTransportSMTP    = "smtp"
+	emailTransportMaildir = "maildir"
+	emailTransportFile    = "file"
+	emailTransportLog     = "log"
+
+	// upgrade a plain connection, usually port 587
+	smtpTLSStartTLS = "starttls"
+	// TLS from the start, usually port 465
+	smtpTLSImplicit = "implicit"
+	// no TLS at all, only for local test servers
+	smtpTLSNone = "none"
+
+	smtpTimeout = 30 * time.Second
+)
+
+// Mailer delivers a complete RFC 5322 message
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+type smtpMailer struct {
+	host     string
+	port     int
+	tls      string
+	username string
+	password string
+}
+
+func (m *smtpMailer) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if m.tls == smtpTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: m.host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (m *smtpMailer) Send(from string, to []string, msg []byte) error {
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+
+	if m.tls == smtpTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+
+	if m.password != "" {
+		// https://www.google.com/settings/security/lesssecureapps
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func uniqueMailName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+// maildirMailer delivers into a maildir, for development and integration tests
+type maildirMailer struct {
+	dir string
+}
+
+func (m *maildirMailer) Send(_ string, _ []string, msg []byte) error {
+	name, err := uniqueMailName()
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	// written to tmp first, so that readers never see a partial message
+	tmp := filepath.Join(m.dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, "new", name))
+}
+
+// fileMailer writes every message as an .eml file, for development and integration tests
+type fileMailer struct {
+	dir string
+}
+
+func (m *fileMailer) Send(_ string, _ []string, msg []byte) error {
+	name, err := uniqueMailName()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.dir, name+".eml"), msg, 0600)
+}
+
+// logMailer only writes messages to the log, for development
+type logMailer struct{}
+
+func (logMailer) Send(from string, to []string, msg []byte) error {
+	log.Printf("[email] from: %s, to: %v\n%s", from, to, msg)
+	return nil
+}
+
+func newMailer(config *Config) (Mailer, error) {
+	c := config.Email
+	switch c.Transport {
+	case emailTransportSMTP, "":
+		tlsMode := c.TLS
+		if tlsMode == "" {
+			tlsMode = smtpTLSStartTLS
+		}
+		if tlsMode != smtpTLSStartTLS && tlsMode != smtpTLSImplicit && tlsMode != smtpTLSNone {
+			return nil, fmt.Errorf("unknown smtp tls: %s", c.TLS)
+		}
+		username := c.Username
+		if username == "" {
+			username = c.From
+		}
+		return &smtpMailer{
+			host:     c.Host,
+			port:     c.Port,
+			tls:      tlsMode,
+			username: username,
+			password: c.Password,
+		}, nil
+	case emailTransportMaildir:
+		return &maildirMailer{dir: c.Dir}, nil
+	case emailTransportFile:
+		return &fileMailer{dir: c.Dir}, nil
+	case emailTransportLog:
+		return logMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown email transport: %s", c.Transport)
+	}
+}
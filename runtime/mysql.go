@@ -37,11 +37,35 @@ func initMysql(config *MysqlConfig) (*gorm.DB, error) {
 		if err := db.AutoMigrate(
 			&models.User{},
 			&models.MetaMask{},
+			&models.ExternalIdentity{},
 			&models.Purchased{},
 			&models.Prediction{},
+			&models.RolePermission{},
+			&models.TOTP{},
+			&models.RecoveryCode{},
+			&models.Session{},
+			&models.APIKey{},
+			&models.OutboxEmail{},
+			&models.NotificationPreferences{},
+			&models.ChainCheckpoint{},
 		); err != nil {
 			return nil, err
 		}
+		if err := seedPermissions(db); err != nil {
+			return nil, err
+		}
 	}
 	return db, nil
 }
+
+func seedPermissions(db *gorm.DB) error {
+	for role, permissions := range models.DefaultRolePermissions {
+		for _, permission := range permissions {
+			rp := models.RolePermission{Role: string(role), Permission: string(permission)}
+			if err := db.Where(&rp).FirstOrCreate(&rp).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
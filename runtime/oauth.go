@@ -0,0 +1,650 @@
+package runtime
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/mylakehead/agile/lib"
+)
+
+/*
+generic OAuth2 authorization code flow with PKCE (RFC 7636),
+OIDC providers only need an issuer, their endpoints are discovered.
+
+the state is bound to the browser which started the flow: Begin returns a binding for a cookie
+and only its hash is stored, a callback without the same cookie is refused (login CSRF).
+an id_token returned by an OIDC provider is verified with the keys of its jwks_uri
+and has to carry the issuer, the client as audience and the nonce of the state.
+
+	oauth/state/<state> -> {"provider": ..., "verifier": ..., "binding": sha256(binding), "nonce": ...}   until the provider redirects back
+*/
+
+// OAuthStateExpire is how long the user has to approve the request at the provider
+const OAuthStateExpire = 10 * time.Minute
+
+const (
+	oauthStatePrefix = "oauth/state/"
+	oauthHTTPTimeout = 10 * time.Second
+	// keys of a provider are fetched again for an unknown kid at most this often
+	oauthJWKSRefresh = time.Minute
+)
+
+var (
+	ErrOAuthProvider = errors.New("unknown oauth provider")
+	ErrOAuthState    = errors.New("invalid oauth state")
+	ErrOAuthExchange = errors.New("oauth code exchange failed")
+	ErrOAuthIDToken  = errors.New("invalid oauth id token")
+)
+
+type OAuthProviderConfig struct {
+	ClientID     string
+	ClientSecret string
+	// OIDC issuer, endpoints below are discovered from it when empty
+	Issuer      string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	RedirectURL string
+	Scopes      []string
+	// send client credentials with HTTP basic auth instead of the form
+	BasicAuth bool
+	// dotted paths into the user info response, e.g. "data.id"
+	SubjectField string
+	EmailField   string
+	NameField    string
+}
+
+// OAuthIdentity is a user as the provider knows it
+type OAuthIdentity struct {
+	Provider string
+	Subject  string
+	Email    string
+	Name     string
+}
+
+type OAuthProvider struct {
+	Name   string
+	config OAuthProviderConfig
+	client *http.Client
+
+	mu         sync.Mutex
+	discovered bool
+	jwksURL    string
+	keys       map[string]*JWTKey
+	keysAt     time.Time
+}
+
+type OAuth struct {
+	redis     *Redis
+	providers map[string]*OAuthProvider
+}
+
+type oauthState struct {
+	Provider string `json:"provider"`
+	Verifier string `json:"verifier"`
+	Binding  string `json:"binding"`
+	Nonce    string `json:"nonce"`
+}
+
+func newOAuth(config *Config, redis *Redis) *OAuth {
+	o := &OAuth{
+		redis:     redis,
+		providers: make(map[string]*OAuthProvider),
+	}
+
+	for name, c := range config.OAuth {
+		// providers without a client are disabled
+		if c.ClientID == "" {
+			continue
+		}
+		if c.SubjectField == "" {
+			c.SubjectField = "sub"
+		}
+		o.providers[name] = &OAuthProvider{
+			Name:   name,
+			config: c,
+			client: &http.Client{Timeout: oauthHTTPTimeout},
+		}
+	}
+
+	return o
+}
+
+func (o *OAuth) Provider(name string) (*OAuthProvider, error) {
+	p, ok := o.providers[name]
+	if !ok {
+		return nil, ErrOAuthProvider
+	}
+	return p, nil
+}
+
+func randomURLString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashOAuthBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+// Begin stores a new state and PKCE verifier,
+// it returns the url to send the user to and the binding to keep in a cookie of the browser until Complete
+func (o *OAuth) Begin(ctx context.Context, provider string) (string, string, error) {
+	p, err := o.Provider(provider)
+	if err != nil {
+		return "", "", err
+	}
+	if err := p.discover(ctx); err != nil {
+		return "", "", err
+	}
+
+	state, err := randomURLString(24)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomURLString(32)
+	if err != nil {
+		return "", "", err
+	}
+	binding, err := randomURLString(32)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomURLString(24)
+	if err != nil {
+		return "", "", err
+	}
+	value, err := json.Marshal(oauthState{
+		Provider: provider,
+		Verifier: verifier,
+		Binding:  hashOAuthBinding(binding),
+		Nonce:    nonce,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if err := o.redis.Cli.Set(ctx, oauthStatePrefix+state, value, OAuthStateExpire).Err(); err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.config.Issuer != "" {
+		query.Set("nonce", nonce)
+	}
+
+	sep := "?"
+	if strings.Contains(p.config.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.config.AuthURL + sep + query.Encode(), binding, nil
+}
+
+// Complete consumes state, checks binding against it, exchanges code and fetches the identity of the user
+func (o *OAuth) Complete(ctx context.Context, provider string, state string, binding string, code string) (*OAuthIdentity, error) {
+	p, err := o.Provider(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := o.redis.Cli.GetDel(ctx, oauthStatePrefix+state).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrOAuthState
+		}
+		return nil, err
+	}
+	s := oauthState{}
+	if err := json.Unmarshal([]byte(value), &s); err != nil {
+		return nil, ErrOAuthState
+	}
+	if s.Provider != provider || s.Binding == "" ||
+		subtle.ConstantTimeCompare([]byte(s.Binding), []byte(hashOAuthBinding(binding))) != 1 {
+		return nil, ErrOAuthState
+	}
+
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	token, err := p.exchange(ctx, code, s.Verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	// without an issuer there are no keys to verify an id_token with, the user info endpoint is trusted alone
+	if token.IDToken == "" || p.config.Issuer == "" {
+		return p.userInfo(ctx, token.AccessToken)
+	}
+
+	identity, err := p.verifyIDToken(ctx, token.IDToken, s.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if p.config.UserInfoURL == "" {
+		return identity, nil
+	}
+
+	// the user info fills what the id_token does not carry, it has to be about the same user
+	info, err := p.userInfo(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	if info.Subject != identity.Subject {
+		return nil, fmt.Errorf("%w: subject differs from the user info", ErrOAuthIDToken)
+	}
+	if identity.Email == "" {
+		identity.Email = info.Email
+	}
+	if identity.Name == "" {
+		identity.Name = info.Name
+	}
+
+	return identity, nil
+}
+
+// discover fills the endpoints of OIDC providers from their issuer once
+func (p *OAuthProvider) discover(ctx context.Context) error {
+	if p.config.Issuer == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovered {
+		return nil
+	}
+
+	endpoint := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	doc := struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}{}
+	if err := p.getJSON(ctx, endpoint, "", &doc); err != nil {
+		return err
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(p.config.Issuer, "/") {
+		return fmt.Errorf("oidc issuer mismatch: %s", doc.Issuer)
+	}
+
+	if p.config.AuthURL == "" {
+		p.config.AuthURL = doc.AuthorizationEndpoint
+	}
+	if p.config.TokenURL == "" {
+		p.config.TokenURL = doc.TokenEndpoint
+	}
+	if p.config.UserInfoURL == "" {
+		p.config.UserInfoURL = doc.UserinfoEndpoint
+	}
+	p.jwksURL = doc.JWKSURI
+	p.discovered = true
+
+	return nil
+}
+
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	// only OIDC providers return one
+	IDToken string `json:"id_token"`
+}
+
+func (p *OAuthProvider) exchange(ctx context.Context, code string, verifier string) (*oauthToken, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if !p.config.BasicAuth {
+		form.Set("client_id", p.config.ClientID)
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.BasicAuth {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrOAuthExchange, resp.Status)
+	}
+
+	token := &oauthToken{}
+	if err := json.Unmarshal(body, token); err != nil || token.AccessToken == "" {
+		return nil, ErrOAuthExchange
+	}
+
+	return token, nil
+}
+
+func (p *OAuthProvider) userInfo(ctx context.Context, token string) (*OAuthIdentity, error) {
+	info := make(map[string]interface{})
+	if err := p.getJSON(ctx, p.config.UserInfoURL, token, &info); err != nil {
+		return nil, err
+	}
+
+	identity := &OAuthIdentity{
+		Provider: p.Name,
+		Subject:  lookupField(info, p.config.SubjectField),
+		Email:    lookupField(info, p.config.EmailField),
+		Name:     lookupField(info, p.config.NameField),
+	}
+	if identity.Subject == "" {
+		return nil, errors.New("oauth user info without subject")
+	}
+
+	return identity, nil
+}
+
+// verifyIDToken checks the signature and the claims of an OIDC id_token and returns the user it is about
+func (p *OAuthProvider) verifyIDToken(ctx context.Context, raw string, nonce string) (*OAuthIdentity, error) {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{UseJSONNumber: true}
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		return p.idTokenKey(ctx, token)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOAuthIDToken, err)
+	}
+
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("%w: no expiration", ErrOAuthIDToken)
+	}
+	issuer, _ := claims["iss"].(string)
+	if strings.TrimSuffix(issuer, "/") != strings.TrimSuffix(p.config.Issuer, "/") {
+		return nil, fmt.Errorf("%w: issuer %s", ErrOAuthIDToken, issuer)
+	}
+	if !hasAudience(claims["aud"], p.config.ClientID) {
+		return nil, fmt.Errorf("%w: not issued to the client", ErrOAuthIDToken)
+	}
+	if party, ok := claims["azp"].(string); ok && party != p.config.ClientID {
+		return nil, fmt.Errorf("%w: authorized party %s", ErrOAuthIDToken, party)
+	}
+	// an id_token of another authorization request would not carry the nonce of this one
+	tokenNonce, _ := claims["nonce"].(string)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOAuthIDToken)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrOAuthIDToken)
+	}
+
+	return &OAuthIdentity{
+		Provider: p.Name,
+		Subject:  subject,
+		Email:    lookupField(claims, p.config.EmailField),
+		Name:     lookupField(claims, p.config.NameField),
+	}, nil
+}
+
+// hasAudience tells whether the aud claim, a string or an array of them, contains audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idTokenKey picks the key of the provider an id_token is verified with, by its kid header
+func (p *OAuthProvider) idTokenKey(ctx context.Context, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// keys are rotated by the provider, an unknown kid makes them fetched again
+	key := p.findKey(kid)
+	if key == nil && time.Since(p.keysAt) >= oauthJWKSRefresh {
+		keys, err := p.fetchKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.keys, p.keysAt = keys, time.Now()
+		key = p.findKey(kid)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("unknown kid %s", kid)
+	}
+	// never let the token choose the algorithm
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.Public, nil
+}
+
+// findKey returns the key of kid, a token without kid is verified with the only key of the provider
+func (p *OAuthProvider) findKey(kid string) *JWTKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key
+		}
+	}
+	return p.keys[kid]
+}
+
+// jsonWebKey is a public key of a JSON Web Key Set (RFC 7517)
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (p *OAuthProvider) fetchKeys(ctx context.Context) (map[string]*JWTKey, error) {
+	if p.jwksURL == "" {
+		return nil, errors.New("oidc provider without jwks_uri")
+	}
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := p.getJSON(ctx, p.jwksURL, "", &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*JWTKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// keys of other types or algorithms can not verify tokens here anyway
+		key, err := parseJWK(&k)
+		if err != nil {
+			continue
+		}
+		keys[key.ID] = key
+	}
+
+	return keys, nil
+}
+
+func parseJWK(k *jsonWebKey) (*JWTKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("malformed jwk")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	var public crypto.PublicKey
+	var alg string
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > math.MaxInt32 {
+			return nil, errors.New("malformed jwk")
+		}
+		public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		alg = "RS256"
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		public = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		alg = map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}[k.Crv]
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported okp key")
+		}
+		public = ed25519.PublicKey(x)
+		alg = lib.EdDSA.Alg()
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+
+	if k.Alg != "" {
+		alg = k.Alg
+	}
+	method := jwt.GetSigningMethod(alg)
+	if method == nil {
+		return nil, fmt.Errorf("unknown algorithm %s", alg)
+	}
+	if err := matchJWTKeyMethod(public, method); err != nil {
+		return nil, err
+	}
+
+	return &JWTKey{ID: k.Kid, Method: method, Public: public}, nil
+}
+
+func (p *OAuthProvider) getJSON(ctx context.Context, endpoint string, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", endpoint, resp.Status)
+	}
+
+	// ids do not fit into float64
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// lookupField follows a dotted path, numeric ids are returned as they are
+func lookupField(info map[string]interface{}, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	var v interface{} = info
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = m[key]
+	}
+
+	switch value := v.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,334 @@
+package runtime
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-redis/redis/v8"
+)
+
+// mockOIDC is an OIDC provider issuing one code per authorization request
+type mockOIDC struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// code -> query of the authorization request
+	requests map[string]url.Values
+	key      *ecdsa.PrivateKey
+	// changes the claims of the id_token before it is signed, the token endpoint returns none if nil
+	idToken func(claims jwt.MapClaims)
+	// signs the id_token instead of key
+	signer *ecdsa.PrivateKey
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{
+		requests: make(map[string]url.Values),
+		key:      key,
+		idToken:  func(claims jwt.MapClaims) {},
+	}
+	mux := http.NewServeMux()
+
+	discovery := func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"userinfo_endpoint":      m.URL + "/userinfo",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	// the document of the issuer above served for another one
+	mux.HandleFunc("/other/.well-known/openid-configuration", discovery)
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.PostFormValue("grant_type") != "authorization_code" ||
+			r.PostFormValue("client_id") != "client" || r.PostFormValue("client_secret") != "secret" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		query, ok := m.requests[r.PostFormValue("code")]
+		delete(m.requests, r.PostFormValue("code"))
+
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != query.Get("code_challenge") {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		token := map[string]string{"access_token": "access", "token_type": "Bearer"}
+		if m.idToken != nil {
+			claims := jwt.MapClaims{
+				"iss":   m.URL,
+				"sub":   "12345678901234567890",
+				"aud":   query.Get("client_id"),
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"iat":   time.Now().Unix(),
+				"nonce": query.Get("nonce"),
+				"email": "user@example.com",
+			}
+			m.idToken(claims)
+			signer := m.key
+			if m.signer != nil {
+				signer = m.signer
+			}
+			idToken := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+			idToken.Header["kid"] = "mock"
+			signed, err := idToken.SignedString(signer)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			token["id_token"] = signed
+		}
+		_ = json.NewEncoder(w).Encode(token)
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				// keys for something else than signatures are skipped
+				{"kid": "mock", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"},
+				{
+					"kid": "mock",
+					"kty": "EC",
+					"crv": "P-256",
+					"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+					"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+				},
+			},
+		})
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, "invalid_token", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"sub": 12345678901234567890, "email": "user@example.com", "profile": {"name": "User"}}`))
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize plays the user approving the request at authURL, it returns the state and the code
+func (m *mockOIDC) authorize(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != "client" || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization url %s", authURL)
+	}
+
+	code := "code-" + query.Get("state")
+	m.mu.Lock()
+	m.requests[code] = query
+	m.mu.Unlock()
+	return query.Get("state"), code
+}
+
+func newTestOAuth(t *testing.T, issuer string) (*OAuth, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	cli := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = cli.Close()
+	})
+
+	return newOAuth(&Config{OAuth: map[string]OAuthProviderConfig{
+		"mock": {
+			ClientID:     "client",
+			ClientSecret: "secret",
+			Issuer:       issuer,
+			RedirectURL:  "https://agile.example.com/oauth/mock/callback",
+			Scopes:       []string{"openid", "email"},
+			EmailField:   "email",
+			NameField:    "profile.name",
+		},
+	}}, &Redis{Cli: cli}), mr
+}
+
+func TestOAuthComplete(t *testing.T) {
+	provider := newMockOIDC(t)
+	o, _ := newTestOAuth(t, provider.URL)
+	ctx := context.Background()
+
+	// with an id_token, the name is only in the user info, and without one
+	want := OAuthIdentity{Provider: "mock", Subject: "12345678901234567890", Email: "user@example.com", Name: "User"}
+	for _, idToken := range []func(jwt.MapClaims){provider.idToken, nil} {
+		provider.idToken = idToken
+
+		authURL, binding, err := o.Begin(ctx, "mock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, code := provider.authorize(t, authURL)
+
+		identity, err := o.Complete(ctx, "mock", state, binding, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *identity != want {
+			t.Errorf("identity = %+v, want %+v", *identity, want)
+		}
+
+		// the state is consumed by the first callback
+		if _, err := o.Complete(ctx, "mock", state, binding, code); !errors.Is(err, ErrOAuthState) {
+			t.Errorf("reused state: %v, want %v", err, ErrOAuthState)
+		}
+		if _, err := o.Complete(ctx, "mock", "unknown", binding, code); !errors.Is(err, ErrOAuthState) {
+			t.Errorf("unknown state: %v, want %v", err, ErrOAuthState)
+		}
+	}
+	if _, _, err := o.Begin(ctx, "unknown"); !errors.Is(err, ErrOAuthProvider) {
+		t.Errorf("unknown provider: %v, want %v", err, ErrOAuthProvider)
+	}
+}
+
+func TestOAuthWrongVerifier(t *testing.T) {
+	provider := newMockOIDC(t)
+	o, mr := newTestOAuth(t, provider.URL)
+	ctx := context.Background()
+
+	authURL, binding, err := o.Begin(ctx, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, code := provider.authorize(t, authURL)
+
+	// a code intercepted by someone who does not have the verifier of the request
+	value, err := json.Marshal(oauthState{Provider: "mock", Verifier: "wrong", Binding: hashOAuthBinding(binding)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.Set(oauthStatePrefix+state, string(value)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := o.Complete(ctx, "mock", state, binding, code); !errors.Is(err, ErrOAuthExchange) {
+		t.Errorf("wrong verifier: %v, want %v", err, ErrOAuthExchange)
+	}
+}
+
+func TestOAuthIssuerMismatch(t *testing.T) {
+	provider := newMockOIDC(t)
+	o, _ := newTestOAuth(t, provider.URL+"/other")
+
+	_, _, err := o.Begin(context.Background(), "mock")
+	if err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("discovery of another issuer: %v", err)
+	}
+}
+
+func TestOAuthBinding(t *testing.T) {
+	provider := newMockOIDC(t)
+	o, _ := newTestOAuth(t, provider.URL)
+	ctx := context.Background()
+
+	authURL, binding, err := o.Begin(ctx, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, code := provider.authorize(t, authURL)
+
+	// the state and code of someone else completed in a browser without their cookie
+	_, other, err := o.Begin(ctx, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{other, ""} {
+		if _, err := o.Complete(ctx, "mock", state, b, code); !errors.Is(err, ErrOAuthState) {
+			t.Errorf("binding %q: %v, want %v", b, err, ErrOAuthState)
+		}
+	}
+
+	// a refused state is consumed too
+	if _, err := o.Complete(ctx, "mock", state, binding, code); !errors.Is(err, ErrOAuthState) {
+		t.Errorf("state after a wrong binding: %v, want %v", err, ErrOAuthState)
+	}
+}
+
+func TestOAuthIDToken(t *testing.T) {
+	provider := newMockOIDC(t)
+	o, _ := newTestOAuth(t, provider.URL)
+	ctx := context.Background()
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		claims func(claims jwt.MapClaims)
+		signer *ecdsa.PrivateKey
+	}{
+		{"signature", func(claims jwt.MapClaims) {}, other},
+		{"issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" }, nil},
+		{"audience", func(claims jwt.MapClaims) { claims["aud"] = []string{"other", "another"} }, nil},
+		{"authorized party", func(claims jwt.MapClaims) {
+			claims["aud"] = []string{"client", "other"}
+			claims["azp"] = "other"
+		}, nil},
+		{"nonce", func(claims jwt.MapClaims) { claims["nonce"] = "replayed" }, nil},
+		{"no nonce", func(claims jwt.MapClaims) { delete(claims, "nonce") }, nil},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }, nil},
+		{"no expiration", func(claims jwt.MapClaims) { delete(claims, "exp") }, nil},
+		{"subject of another user", func(claims jwt.MapClaims) { claims["sub"] = "1" }, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider.idToken, provider.signer = tc.claims, tc.signer
+
+			authURL, binding, err := o.Begin(ctx, "mock")
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, code := provider.authorize(t, authURL)
+			if _, err := o.Complete(ctx, "mock", state, binding, code); !errors.Is(err, ErrOAuthIDToken) {
+				t.Errorf("Complete = %v, want %v", err, ErrOAuthIDToken)
+			}
+		})
+	}
+
+	// several audiences with the client as authorized party
+	provider.idToken = func(claims jwt.MapClaims) {
+		claims["aud"] = []string{"other", "client"}
+		claims["azp"] = "client"
+	}
+	provider.signer = nil
+	authURL, binding, err := o.Begin(ctx, "mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, code := provider.authorize(t, authURL)
+	if _, err := o.Complete(ctx, "mock", state, binding, code); err != nil {
+		t.Errorf("Complete = %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package runtime
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/mylakehead/agile/models"
+)
+
+/*
+emails are stored in the outbox_email table and delivered by a pool of workers,
+so that requests neither wait for nor fail because of the mail server.
+
+a message is claimed by setting locked_until, so that a message whose worker died is picked up again.
+failed deliveries are retried with exponential backoff, after the last attempt the message is failed.
+the message itself is emptied once it is sent or failed, the row is kept for the retention and then purged.
+*/
+
+const (
+	defaultOutboxWorkers     = 4
+	defaultOutboxMaxAttempts = 8
+	defaultOutboxRetention   = 30 * 24 * time.Hour
+
+	outboxPollInterval = time.Second
+	outboxBatch        = 32
+	outboxLease        = 2 * smtpTimeout
+	outboxBackoff      = 30 * time.Second
+	outboxMaxBackoff   = time.Hour
+)
+
+type Outbox struct {
+	db          *gorm.DB
+	mailer      Mailer
+	workers     int
+	maxAttempts int
+	retention   time.Duration
+
+	jobs chan *models.OutboxEmail
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newOutbox(config *Config, db *gorm.DB, mailer Mailer) *Outbox {
+	workers := config.Email.Workers
+	if workers <= 0 {
+		workers = defaultOutboxWorkers
+	}
+	maxAttempts := config.Email.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultOutboxMaxAttempts
+	}
+	retention := time.Duration(config.Email.OutboxRetention) * time.Second
+	if retention <= 0 {
+		retention = defaultOutboxRetention
+	}
+
+	o := &Outbox{
+		db:          db,
+		mailer:      mailer,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		retention:   retention,
+		jobs:        make(chan *models.OutboxEmail),
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	for i := 0; i < workers; i++ {
+		o.wg.Add(1)
+		go o.work()
+	}
+	go o.dispatch()
+
+	return o
+}
+
+// Enqueue stores a message for delivery and returns its id
+func (o *Outbox) Enqueue(from string, to string, subject string, msg []byte) (uint, error) {
+	email := models.OutboxEmail{
+		From:          from,
+		To:            to,
+		Subject:       subject,
+		Message:       msg,
+		Status:        string(models.OutboxPending),
+		NextAttemptAt: time.Now(),
+	}
+	if err := o.db.Create(&email).Error; err != nil {
+		return 0, err
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return email.ID, nil
+}
+
+// Purge deletes the sent and failed messages last updated before the retention, it returns how many
+func (o *Outbox) Purge() (int64, error) {
+	result := o.db.Where(
+		"status IN ? AND updated_at < ?", []models.OutboxStatus{models.OutboxSent, models.OutboxFailed},
+		time.Now().Add(-o.retention),
+	).Delete(&models.OutboxEmail{})
+	return result.RowsAffected, result.Error
+}
+
+func (o *Outbox) dispatch() {
+	defer close(o.done)
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+
+		for {
+			n, err := o.dispatchDue()
+			if err != nil {
+				log.Printf("[outbox] %v", err)
+			}
+			if err != nil || n < outboxBatch {
+				break
+			}
+		}
+	}
+}
+
+// due returns the pending messages whose next attempt is due and that are not claimed
+func (o *Outbox) due(now time.Time) ([]models.OutboxEmail, error) {
+	var due []models.OutboxEmail
+	err := o.db.Where(
+		"status = ? AND next_attempt_at <= ? AND (locked_until IS NULL OR locked_until < ?)",
+		models.OutboxPending, now, now,
+	).Order("next_attempt_at").Limit(outboxBatch).Find(&due).Error
+	return due, err
+}
+
+// claim locks email for one attempt, false if another instance claimed it first
+func (o *Outbox) claim(email *models.OutboxEmail, now time.Time) (bool, error) {
+	result := o.db.Model(&models.OutboxEmail{}).Where(
+		"id = ? AND status = ? AND (locked_until IS NULL OR locked_until < ?)", email.ID, models.OutboxPending, now,
+	).Updates(map[string]interface{}{
+		"locked_until": now.Add(outboxLease),
+		"attempts":     gorm.Expr("attempts + 1"),
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	email.Attempts++
+	return true, nil
+}
+
+// dispatchDue claims the messages due now and hands them to the workers
+func (o *Outbox) dispatchDue() (int, error) {
+	now := time.Now()
+	due, err := o.due(now)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range due {
+		ok, err := o.claim(&due[i], now)
+		if err != nil {
+			return i, err
+		}
+		if !ok {
+			continue
+		}
+
+		select {
+		case o.jobs <- &due[i]:
+		case <-o.stop:
+			// Close drains the rest, the lease of this one runs out and it is picked up again
+			return i, nil
+		}
+	}
+
+	return len(due), nil
+}
+
+func (o *Outbox) work() {
+	defer o.wg.Done()
+
+	for email := range o.jobs {
+		o.deliver(email)
+	}
+}
+
+func (o *Outbox) deliver(email *models.OutboxEmail) {
+	err := o.mailer.Send(email.From, []string{email.To}, email.Message)
+
+	now := time.Now()
+	updates := map[string]interface{}{
+		"locked_until": nil,
+	}
+	switch {
+	case err == nil:
+		updates["status"] = models.OutboxSent
+		updates["sent_at"] = now
+		updates["last_error"] = ""
+		updates["message"] = []byte{}
+	case email.Attempts >= o.maxAttempts:
+		log.Printf("[outbox] email %d to %s failed for good: %v", email.ID, email.To, err)
+		updates["status"] = models.OutboxFailed
+		updates["last_error"] = err.Error()
+		updates["message"] = []byte{}
+	default:
+		updates["next_attempt_at"] = now.Add(outboxRetryAfter(email.Attempts))
+		updates["last_error"] = err.Error()
+	}
+
+	if err := o.db.Model(email).Updates(updates).Error; err != nil {
+		log.Printf("[outbox] update email %d: %v", email.ID, err)
+	}
+}
+
+// outboxRetryAfter doubles the wait after every failed attempt
+func outboxRetryAfter(attempts int) time.Duration {
+	backoff := outboxBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// Close stops polling, delivers what is due until there is nothing left or ctx is done,
+// then waits for the workers
+func (o *Outbox) Close(ctx context.Context) error {
+	close(o.stop)
+	<-o.done
+
+	err := o.drain(ctx)
+	close(o.jobs)
+
+	finished := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *Outbox) drain(ctx context.Context) error {
+	for ctx.Err() == nil {
+		now := time.Now()
+		due, err := o.due(now)
+		if err != nil {
+			return err
+		}
+
+		claimed := 0
+		for i := range due {
+			if ctx.Err() != nil {
+				break
+			}
+			ok, err := o.claim(&due[i], now)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+
+			select {
+			case o.jobs <- &due[i]:
+				claimed++
+			case <-ctx.Done():
+				// every worker is busy, the lease of this one runs out and it is retried on the next start
+				return ctx.Err()
+			}
+		}
+		// messages that fail again are due only after their backoff, so this ends
+		if claimed == 0 {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mylakehead/agile/models"
+)
+
+// blockedMailer does not return from Send until release is closed
+type blockedMailer struct {
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (m *blockedMailer) Send(from string, to []string, msg []byte) error {
+	m.sending <- struct{}{}
+	<-m.release
+	return nil
+}
+
+func TestOutboxCloseBusyWorkers(t *testing.T) {
+	db := newTestDB(t, &models.OutboxEmail{})
+	mailer := &blockedMailer{sending: make(chan struct{}, 2), release: make(chan struct{})}
+	// one worker and no dispatcher, so that Close is the one handing out the messages
+	o := &Outbox{
+		db:          db,
+		mailer:      mailer,
+		workers:     1,
+		maxAttempts: defaultOutboxMaxAttempts,
+		retention:   defaultOutboxRetention,
+		jobs:        make(chan *models.OutboxEmail),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	close(o.done)
+	o.wg.Add(1)
+	go o.work()
+	t.Cleanup(func() {
+		close(mailer.release)
+		o.wg.Wait()
+	})
+
+	for _, to := range []string{"first@example.com", "second@example.com"} {
+		if _, err := o.Enqueue("noreply@example.com", to, "subject", []byte("message")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		closed <- o.Close(ctx)
+	}()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Close = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close does not return while the worker is busy")
+	}
+	if len(mailer.sending) != 1 {
+		t.Fatalf("%d messages being sent, want 1", len(mailer.sending))
+	}
+
+	// the second one is still pending, it is sent once its lease runs out
+	var second models.OutboxEmail
+	if err := db.Where("`to` = ?", "second@example.com").First(&second).Error; err != nil {
+		t.Fatal(err)
+	}
+	if second.Status != string(models.OutboxPending) || second.LockedUntil == nil {
+		t.Errorf("second message %s, locked until %v", second.Status, second.LockedUntil)
+	}
+}
@@ -2,6 +2,7 @@ package runtime
 
 import (
 	"context"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -12,10 +13,28 @@ type Runtime struct {
 	Mysql  *gorm.DB
 	Redis  *Redis
 	Email  *Email
+	SMS    SMSSender
+	OAuth  *OAuth
+	Keys   *JWTKeys
+	// nil if no chain is configured
+	Chain *Chain
+	// nil without a chain or a market
+	Indexer *Indexer
 }
 
-func New() (*Runtime, error) {
+// closeOnErrorTimeout bounds closing what New opened before a step failed
+const closeOnErrorTimeout = 5 * time.Second
+
+func New() (_ *Runtime, err error) {
 	rt := &Runtime{}
+	defer func() {
+		// the outbox workers, the chain client and the connections opened before the step that failed
+		if err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), closeOnErrorTimeout)
+			defer cancel()
+			_ = rt.Close(ctx)
+		}
+	}()
 
 	flags, err := parseFlags()
 	if err != nil {
@@ -29,6 +48,12 @@ func New() (*Runtime, error) {
 	}
 	rt.Config = config
 
+	keys, err := newJWTKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	rt.Keys = keys
+
 	db, err := initMysql(&config.Mysql)
 	if err != nil {
 		return nil, err
@@ -40,32 +65,70 @@ func New() (*Runtime, error) {
 		return nil, err
 	}
 	rt.Redis = redis
+	rt.OAuth = newOAuth(config, redis)
 
-	email, err := newEmail(config)
+	email, err := newEmail(config, db)
 	if err != nil {
 		return nil, err
 	}
 	rt.Email = email
 
+	sms, err := newSMS(config)
+	if err != nil {
+		return nil, err
+	}
+	rt.SMS = sms
+
+	chain, err := newChain(config)
+	if err != nil {
+		return nil, err
+	}
+	rt.Chain = chain
+
+	indexer, err := newIndexer(config, db, chain)
+	if err != nil {
+		return nil, err
+	}
+	if indexer != nil {
+		indexer.Start()
+	}
+	rt.Indexer = indexer
+
 	return rt, nil
 }
 
 func (r *Runtime) Close(ctx context.Context) error {
-	// TODO ctx
-	defer ctx.Done()
+	// the indexer and the outbox before mysql is closed, so that the range being indexed and the queued emails
+	// are still written, what is left when ctx is done is done again on the next start
+	var closeErr error
+	if r.Indexer != nil {
+		closeErr = r.Indexer.Close(ctx)
+	}
+	if r.Email != nil {
+		if err := r.Email.Outbox.Close(ctx); closeErr == nil {
+			closeErr = err
+		}
+	}
 
-	err := r.Redis.Close()
-	if err != nil {
-		return err
+	if r.Chain != nil {
+		r.Chain.Close()
 	}
 
-	sqlDB, err := r.Mysql.DB()
-	if err != nil {
-		return err
+	if r.Redis != nil {
+		if err := r.Redis.Close(); err != nil {
+			return err
+		}
 	}
-	if err := sqlDB.Close(); err != nil {
-		return err
+
+	if r.Mysql != nil {
+		sqlDB, err := r.Mysql.DB()
+		if err != nil {
+			return err
+		}
+		if err := sqlDB.Close(); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return closeErr
 }
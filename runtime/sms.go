@@ -0,0 +1,60 @@
+package runtime
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	smsTransportLog  = "log"
+	smsTransportFile = "file"
+)
+
+// SMSSender delivers text messages to E.164 phone numbers
+type SMSSender interface {
+	Send(to string, message string) error
+}
+
+// logSMS only writes messages to the log, for development
+type logSMS struct{}
+
+func (logSMS) Send(to string, message string) error {
+	log.Printf("[sms] to: %s, message: %s", to, message)
+	return nil
+}
+
+// fileSMS appends messages to a file, for development and integration tests
+type fileSMS struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (f *fileSMS) Send(to string, message string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), to, message)
+	return err
+}
+
+func newSMS(config *Config) (SMSSender, error) {
+	switch config.SMS.Transport {
+	case smsTransportLog, "":
+		return logSMS{}, nil
+	case smsTransportFile:
+		return &fileSMS{path: config.SMS.File}, nil
+	default:
+		return nil, fmt.Errorf("unknown sms transport: %s", config.SMS.Transport)
+	}
+}
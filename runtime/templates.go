@@ -0,0 +1,169 @@
+package runtime
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"golang.org/x/text/language"
+)
+
+/*
+email templates are read from one directory per kind of message, with one directory per locale in it:
+
+	<templates>/<kind>/<locale>/subject.template   text, a single line
+	<templates>/<kind>/<locale>/text.template      text, the text/plain part
+	<templates>/<kind>/<locale>/html.template      html, the text/html part
+
+every kind must have the default locale, which is used for locales it is not translated to.
+*/
+
+const (
+	EmailKindCaptcha      = "captcha"
+	EmailKindReset        = "reset"
+	EmailKindAnnouncement = "announcement"
+
+	defaultEmailLocale = "en"
+)
+
+var emailKinds = []string{EmailKindCaptcha, EmailKindReset, EmailKindAnnouncement}
+
+type emailTemplate struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// EmailTemplates are the templates of every kind of email in every locale
+type EmailTemplates struct {
+	defaultLocale string
+	// supported[0] is the default locale
+	supported []language.Tag
+	matcher   language.Matcher
+	// kind -> locale -> template
+	templates map[string]map[string]*emailTemplate
+}
+
+func loadEmailTemplate(dir string) (*emailTemplate, error) {
+	subject, err := template.ParseFiles(filepath.Join(dir, "subject.template"))
+	if err != nil {
+		return nil, err
+	}
+	text, err := template.ParseFiles(filepath.Join(dir, "text.template"))
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.ParseFiles(filepath.Join(dir, "html.template"))
+	if err != nil {
+		return nil, err
+	}
+	return &emailTemplate{subject: subject, text: text, html: html}, nil
+}
+
+func newEmailTemplates(config *Config) (*EmailTemplates, error) {
+	defaultLocale := config.Email.DefaultLocale
+	if defaultLocale == "" {
+		defaultLocale = defaultEmailLocale
+	}
+	defaultTag, err := language.Parse(defaultLocale)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email default locale %s: %w", defaultLocale, err)
+	}
+
+	t := &EmailTemplates{
+		defaultLocale: defaultTag.String(),
+		templates:     make(map[string]map[string]*emailTemplate),
+	}
+
+	locales := make(map[string]language.Tag)
+	for _, kind := range emailKinds {
+		entries, err := os.ReadDir(filepath.Join(config.Email.Templates, kind))
+		if err != nil {
+			return nil, err
+		}
+
+		t.templates[kind] = make(map[string]*emailTemplate)
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			tag, err := language.Parse(entry.Name())
+			if err != nil {
+				return nil, fmt.Errorf("invalid email template locale %s/%s: %w", kind, entry.Name(), err)
+			}
+			tmpl, err := loadEmailTemplate(filepath.Join(config.Email.Templates, kind, entry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			t.templates[kind][tag.String()] = tmpl
+			locales[tag.String()] = tag
+		}
+
+		if t.templates[kind][t.defaultLocale] == nil {
+			return nil, fmt.Errorf("email template %s has no default locale %s", kind, t.defaultLocale)
+		}
+	}
+
+	// the matcher falls back to the first tag
+	t.supported = append(t.supported, defaultTag)
+	delete(locales, t.defaultLocale)
+	names := make([]string, 0, len(locales))
+	for name := range locales {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.supported = append(t.supported, locales[name])
+	}
+	t.matcher = language.NewMatcher(t.supported)
+
+	return t, nil
+}
+
+// Locale returns the supported locale closest to accept,
+// a single tag such as fr-CA or an Accept-Language header, the default locale if none is close
+func (t *EmailTemplates) Locale(accept string) string {
+	tags, _, err := language.ParseAcceptLanguage(accept)
+	if err != nil || len(tags) == 0 {
+		return t.defaultLocale
+	}
+	_, i, confidence := t.matcher.Match(tags...)
+	if confidence == language.No {
+		return t.defaultLocale
+	}
+	return t.supported[i].String()
+}
+
+// render returns the subject, text and html of kind in the locale closest to locale,
+// the text and html templates find the subject in data as well
+func (t *EmailTemplates) render(kind string, locale string, data map[string]interface{}) (string, []byte, []byte, error) {
+	tmpl := t.templates[kind][t.Locale(locale)]
+	if tmpl == nil {
+		tmpl = t.templates[kind][t.defaultLocale]
+	}
+	if tmpl == nil {
+		return "", nil, nil, fmt.Errorf("unknown email template: %s", kind)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return "", nil, nil, err
+	}
+	// a header, so line breaks are not allowed
+	line := strings.Join(strings.Fields(subject.String()), " ")
+	data["Subject"] = line
+
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return "", nil, nil, err
+	}
+	if err := tmpl.html.Execute(&html, data); err != nil {
+		return "", nil, nil, err
+	}
+
+	return line, text.Bytes(), html.Bytes(), nil
+}